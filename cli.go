@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+)
+
+// command is a node in the command tree. Commands with subcommands only
+// group them, leaf commands have their own flags, the backends and filter
+// ids they need and a run function.
+type command struct {
+	name        string
+	short       string
+	flags       *pflag.FlagSet
+	subcommands []*command
+	backends    backend
+	filter      filterNeed
+	run         func(a *app) error
+}
+
+// backend is a set of the backends a command needs, only those are
+// connected to before the command runs
+type backend int
+
+const (
+	backendMetadata backend = 1 << iota
+	backendInbox
+	backendDatabase
+)
+
+// errUsage is returned when the command line could not be parsed, the
+// usage has already been printed when it is returned
+var errUsage = errors.New("invalid usage")
+
+// programName is the name used in usage messages
+var programName = filepath.Base(os.Args[0])
+
+// parseCommandLine walks the command tree following the given arguments
+// and returns the leaf command to run with its flags parsed
+func parseCommandLine(root *command, args []string) (*command, error) {
+	cmd := root
+	path := []string{programName}
+
+	for len(cmd.subcommands) > 0 {
+		if len(args) == 0 {
+			cmd.printUsage(os.Stderr, path)
+
+			return nil, errUsage
+		}
+
+		name := args[0]
+		switch name {
+		case "-h", "--help", "help":
+			cmd.printUsage(os.Stderr, path)
+
+			return nil, pflag.ErrHelp
+		}
+
+		sub := cmd.subcommand(name)
+		if sub == nil {
+			fmt.Fprintf(os.Stderr, "unknown command %q for %q\n\n", name, strings.Join(path, " "))
+			cmd.printUsage(os.Stderr, path)
+
+			return nil, errUsage
+		}
+
+		cmd = sub
+		path = append(path, name)
+		args = args[1:]
+	}
+
+	if cmd.flags == nil {
+		cmd.flags = pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	}
+	cmd.flags.AddFlagSet(globalFlags())
+	cmd.flags.SetOutput(os.Stderr)
+	cmd.flags.Usage = func() { cmd.printUsage(os.Stderr, path) }
+
+	if err := cmd.flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return nil, err
+		}
+
+		return nil, errUsage
+	}
+
+	if cmd.flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q for %q\n\n", cmd.flags.Arg(0), strings.Join(path, " "))
+		cmd.printUsage(os.Stderr, path)
+
+		return nil, errUsage
+	}
+
+	return cmd, nil
+}
+
+// globalFlags returns the flags accepted by every command
+func globalFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("global", pflag.ContinueOnError)
+	flags.Duration("timeout", 0, "maximum time the command may take, 0 for no limit")
+
+	return flags
+}
+
+// subcommand returns the direct subcommand with the given name, or nil
+func (cmd *command) subcommand(name string) *command {
+	for _, sub := range cmd.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+// printUsage writes the help text of the command to w, path is the
+// sequence of command names leading to it
+func (cmd *command) printUsage(w io.Writer, path []string) {
+	if len(cmd.subcommands) > 0 {
+		fmt.Fprintf(w, "Usage: %s <command>\n\n", strings.Join(path, " "))
+		if cmd.short != "" {
+			fmt.Fprintf(w, "%s\n\n", cmd.short)
+		}
+		fmt.Fprintln(w, "Commands:")
+		tw := tabwriter.NewWriter(w, 0, 0, 4, ' ', 0)
+		for _, sub := range cmd.subcommands {
+			fmt.Fprintf(tw, "  %s\t%s\n", sub.name, sub.short)
+		}
+		tw.Flush()
+		fmt.Fprintf(w, "\nUse \"%s <command> --help\" for more information about a command.\n", strings.Join(path, " "))
+
+		return
+	}
+
+	fmt.Fprintf(w, "Usage: %s [flags]\n\n", strings.Join(path, " "))
+	if cmd.short != "" {
+		fmt.Fprintf(w, "%s\n\n", cmd.short)
+	}
+	if cmd.flags != nil && cmd.flags.HasFlags() {
+		fmt.Fprintln(w, "Flags:")
+		fmt.Fprint(w, cmd.flags.FlagUsages())
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"metadata-reviewer/main/render"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// app holds the configuration and backends shared by all commands
+type app struct {
+	ctx      context.Context
+	conf     *Config
+	metadata metadataRepository
+	inbox    *s3Backend
+	db       Database
+	flags    *pflag.FlagSet
+	filter   metadataFilter
+	output   render.Format
+}
+
+// commands is the root of the command tree
+var commands = &command{
+	short: "Review submissions in the metadata store",
+	subcommands: []*command{
+		{
+			name:  "users",
+			short: "Inspect users of the metadata store",
+			subcommands: []*command{
+				{
+					name:     "list",
+					short:    "List all users",
+					flags:    addOutputFlag(pflag.NewFlagSet("list", pflag.ContinueOnError)),
+					backends: backendMetadata,
+					run:      listUsers,
+				},
+			},
+		},
+		{
+			name:  "folders",
+			short: "Inspect submission folders",
+			subcommands: []*command{
+				{
+					name:     "list",
+					short:    "List the folders of the user in the filter",
+					flags:    addOutputFlag(filterFlags("list")),
+					backends: backendMetadata,
+					run:      listFolders,
+				},
+			},
+		},
+		{
+			name:  "objects",
+			short: "Inspect metadata objects",
+			subcommands: []*command{
+				{
+					name:     "list",
+					short:    "List the metadata objects matching the filter",
+					flags:    addOutputFlag(filterFlags("list")),
+					backends: backendMetadata,
+					filter:   needAnyID,
+					run:      listObjects,
+				},
+			},
+		},
+		{
+			name:  "crossref",
+			short: "Cross reference metadata files with the SDA backends",
+			subcommands: []*command{
+				{
+					name:     "inbox",
+					short:    "Check that the files in the metadata exist in the S3 inbox",
+					flags:    crossRefInboxFlags(),
+					backends: backendMetadata | backendInbox,
+					filter:   needAnyID,
+					run:      crossRefInbox,
+				},
+				{
+					name:     "ingestion",
+					short:    "Check that the files in the metadata have been ingested",
+					flags:    addWorkerFlags(addOutputFlag(filterFlags("ingestion"))),
+					backends: backendMetadata | backendDatabase,
+					filter:   needAnyID,
+					run:      crossRefIngestion,
+				},
+				{
+					name:     "orphans",
+					short:    "List the inbox objects not referenced by the metadata of the user",
+					flags:    orphansFlags(),
+					backends: backendMetadata | backendInbox,
+					filter:   needOwner,
+					run:      inboxOrphans,
+				},
+			},
+		},
+		{
+			name:  "doctor",
+			short: "Check the configuration and the connection to every backend",
+			flags: doctorFlags(),
+			run:   runDoctor,
+		},
+		{
+			name:     "reconcile",
+			short:    "Reconcile the files of a folder between metadata, inbox and archive",
+			flags:    reconcileFlags(),
+			backends: backendMetadata | backendInbox | backendDatabase,
+			filter:   needFolder,
+			run:      reconcile,
+		},
+	},
+}
+
+// crossRefInboxFlags returns the flags of the crossref inbox command
+func crossRefInboxFlags() *pflag.FlagSet {
+	flags := addWorkerFlags(addOutputFlag(filterFlags("inbox")))
+	flags.Bool("verify-content", false, "download the inbox objects and compare their MD5 or SHA-256 with the metadata")
+	flags.String("verify-cache", "", "file keeping the verified checksums to resume an interrupted verification, none by default")
+
+	return flags
+}
+
+// orphansFlags returns the flags of the crossref orphans command
+func orphansFlags() *pflag.FlagSet {
+	flags := addOutputFlag(filterFlags("orphans"))
+	flags.String("inbox-prefix", "", "list the inbox objects under this prefix, defaults to the inbox directory of the user, empty for the whole inbox")
+
+	return flags
+}
+
+// reconcileFlags returns the flags of the reconcile command
+func reconcileFlags() *pflag.FlagSet {
+	flags := addWorkerFlags(addOutputFlag(filterFlags("reconcile")))
+	flags.String("inbox-prefix", "", "list the inbox objects under this prefix when looking for orphans, defaults to the inbox directory of the folder owner, empty for the whole inbox")
+	flags.String("submission-user", "", "submitter in the ingestion database, defaults to the eppn of the folder owner")
+
+	return flags
+}
+
+// errNoInboxPrefix is returned when looking for orphans without knowing
+// the inbox directory of the user, since the objects of all other users
+// would be reported
+var errNoInboxPrefix = errors.New("the inbox directory of the user is unknown, set s3.pathPrefix or give --inbox-prefix, empty to list the whole inbox")
+
+// inboxPrefix returns the prefix given with --inbox-prefix, which may be
+// empty to list the whole inbox, or the prefix of the inbox keys of the
+// user when the flag is not set
+func inboxPrefix(a *app, user User) (string, error) {
+	if a.flags.Changed("inbox-prefix") {
+		return a.flags.GetString("inbox-prefix")
+	}
+
+	prefix, err := a.inbox.UserPrefix(user)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the inbox directory of %s: %v", user.ID, err)
+	}
+	if prefix == "" {
+		return "", errNoInboxPrefix
+	}
+
+	return prefix, nil
+}
+
+// listUsers prints all users in the metadata store
+func listUsers(a *app) error {
+	users, err := a.metadata.users(a.ctx)
+	if err != nil {
+		return err
+	}
+
+	records := make([]render.Record, len(users))
+	for i, u := range users {
+		records[i] = u
+	}
+
+	return render.Print(os.Stdout, a.output, records)
+}
+
+// listFolders prints the folders belonging to the user in the filter
+func listFolders(a *app) error {
+	user, err := a.metadata.user(a.ctx, a.filter.UserID)
+	if err != nil {
+		return err
+	}
+	folders, err := a.metadata.folders(a.ctx, user.Folders)
+	if err != nil {
+		return err
+	}
+
+	records := make([]render.Record, len(folders))
+	for i, f := range folders {
+		records[i] = f
+	}
+
+	return render.Print(os.Stdout, a.output, records)
+}
+
+// listObjects prints the metadata objects in the folders matching the filter
+func listObjects(a *app) error {
+	accessionIds, schemas, err := a.metadata.filterObjects(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+
+	var records []render.Record
+	for _, sch := range schemas {
+		objects, err := a.metadata.metadataObjects(a.ctx, sch, accessionIds)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			records = append(records, obj)
+		}
+	}
+
+	return render.Print(os.Stdout, a.output, records)
+}
+
+// crossRefInbox checks that the files in the metadata exist in the inbox
+func crossRefInbox(a *app) error {
+	log.Info("Cross reference started")
+	files, err := a.metadata.metadataFiles(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+
+	user, err := a.metadata.submitter(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+	pool := newWorkerPool(a.flags)
+
+	results := make([]CrossRefResult, len(files))
+	for i, file := range files {
+		results[i] = newCrossRefResult(file)
+	}
+
+	if err := checkInboxFiles(a.ctx, pool, a.inbox, results, user); err != nil {
+		return err
+	}
+
+	if verify, _ := a.flags.GetBool("verify-content"); verify {
+		cachePath, _ := a.flags.GetString("verify-cache")
+		cache, err := loadVerifyCache(cachePath)
+		if err != nil {
+			return err
+		}
+		var privateKey *[32]byte
+		if a.conf.c4gh.filePath != "" {
+			key, err := readCrypt4GHPrivateKey(a.conf.c4gh.filePath, a.conf.c4gh.passphrase)
+			if err != nil {
+				return err
+			}
+			privateKey = &key
+		}
+
+		if err := verifyContent(a.ctx, pool, a.inbox, results, cache, privateKey); err != nil {
+			return err
+		}
+	}
+
+	return reportCrossRef(a, results)
+}
+
+// crossRefIngestion checks that the files in the metadata exist in the
+// ingestion database
+func crossRefIngestion(a *app) error {
+	log.Info("Cross reference started")
+	files, err := a.metadata.metadataFiles(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+	user, err := a.metadata.submitter(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+
+	results := make([]CrossRefResult, len(files))
+	for i, file := range files {
+		results[i] = newCrossRefResult(file)
+	}
+
+	if err := checkArchive(a.ctx, newWorkerPool(a.flags), a.db, results, user); err != nil {
+		return err
+	}
+
+	return reportCrossRef(a, results)
+}
+
+// inboxOrphans lists the objects in the inbox that are not referenced by
+// any metadata object in the folders of the user, or of the owner of the
+// folder in the filter
+func inboxOrphans(a *app) error {
+	log.Info("Listing inbox orphans")
+
+	// all files in the folders of the owner count as referenced, not only
+	// the ones of a single folder or object
+	user, err := a.metadata.submitter(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+	files, err := a.metadata.userFiles(a.ctx, user)
+	if err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for _, file := range files {
+		key, err := a.inbox.ObjectKey(file.FileName, user)
+		if err != nil {
+			return err
+		}
+		referenced[key] = true
+	}
+
+	prefix, err := inboxPrefix(a, user)
+	if err != nil {
+		return err
+	}
+	inboxObjects, err := a.inbox.ListFiles(a.ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	var records []render.Record
+	for _, obj := range inboxObjects {
+		if !referenced[obj.Key] {
+			records = append(records, obj)
+		}
+	}
+
+	if err := render.Print(os.Stdout, a.output, records); err != nil {
+		return err
+	}
+
+	log.Infof("%d of %d inbox objects are not referenced by the metadata", len(records), len(inboxObjects))
+	if len(records) > 0 {
+		return errNotInOrder
+	}
+
+	return nil
+}
+
+// reconcile checks every file of a folder against the inbox and the
+// archive, and reports the files in the inbox or the archive that are not
+// referenced by the metadata
+func reconcile(a *app) error {
+	log.Info("Reconciliation started")
+	files, err := a.metadata.metadataFiles(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+	user, err := a.metadata.submitter(a.ctx, a.filter)
+	if err != nil {
+		return err
+	}
+	pool := newWorkerPool(a.flags)
+
+	results := make([]CrossRefResult, len(files))
+	for i, file := range files {
+		results[i] = newCrossRefResult(file)
+	}
+
+	if err := checkInboxFiles(a.ctx, pool, a.inbox, results, user); err != nil {
+		return err
+	}
+
+	if err := checkArchive(a.ctx, pool, a.db, results, user); err != nil {
+		return err
+	}
+
+	// the files of the other folders of the owner are not orphans, they are
+	// referenced by their mapped paths in each backend
+	userFiles, err := a.metadata.userFiles(a.ctx, user)
+	if err != nil {
+		return err
+	}
+	referencedKeys := map[string]bool{}
+	referencedPaths := map[string]bool{}
+	for _, file := range userFiles {
+		key, err := a.inbox.ObjectKey(file.FileName, user)
+		if err != nil {
+			return err
+		}
+		path, err := a.db.SubmissionPath(file.FileName, user)
+		if err != nil {
+			return err
+		}
+		referencedKeys[key] = true
+		referencedPaths[path] = true
+	}
+
+	prefix, err := inboxPrefix(a, user)
+	if err != nil {
+		return err
+	}
+	inboxObjects, err := a.inbox.ListFiles(a.ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	submissionUser, _ := a.flags.GetString("submission-user")
+	if submissionUser == "" {
+		submissionUser = user.Eppn
+	}
+
+	var ingestedFiles []IngestedFile
+	if submissionUser != "" {
+		ingestedFiles, err = a.db.GetUserFiles(a.ctx, submissionUser)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Warn("No submission user known, skipping the ingested files that are not in the metadata")
+	}
+
+	// an orphan in both backends gets a single row, keyed by its name
+	// without the mapping of either backend
+	orphans := orphanSet{}
+	for _, obj := range inboxObjects {
+		if referencedKeys[obj.Key] {
+			continue
+		}
+		name, err := a.inbox.FileName(obj.Key, user)
+		if err != nil {
+			return err
+		}
+		orphan := orphans.get(name)
+		orphan.InboxKey = obj.Key
+		orphan.setInbox(true)
+	}
+	for _, f := range ingestedFiles {
+		if !referencedPaths[f.Path] {
+			name, err := a.db.FileName(f.Path, user)
+			if err != nil {
+				return err
+			}
+			orphan := orphans.get(name)
+			orphan.SubmissionPath = f.Path
+			orphan.setArchive(archivedStatuses[f.Status])
+			orphan.DecryptedChecksum = f.Checksum
+			orphan.DecryptedChecksumType = f.ChecksumType
+		}
+	}
+
+	return reportCrossRef(a, append(results, orphans.results(submissionUser != "")...))
+}
@@ -2,26 +2,28 @@ package main
 
 import (
 	"errors"
-	"flag"
+	"io/ioutil"
 	"path"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-// ClFlags is an struc that holds cl flags info
-type ClFlags struct {
-	action string
-}
-
 // Config is a parent object for all the different configuration parts
 type Config struct {
 	mongo    mongoConfig
 	s3       S3Config
 	postgres DBConfig
+	c4gh     c4ghConfig
+	// postgresErr tells why the database configuration is invalid
+	postgresErr error
+}
+
+// c4ghConfig holds the private key used to decrypt inbox files
+type c4ghConfig struct {
+	filePath   string
+	passphrase string
 }
 
 // NewConfig initializes and parses the config file and/or environment using
@@ -35,36 +37,65 @@ func NewConfig() *Config {
 	return c
 }
 
-// getCLflags returns the given CL options
-func getCLflags() ClFlags {
-
-	flag.String("action", "", "action to perform")
+// configSecret returns the value of key, or the content of the file given
+// with <key>File, so that secrets can be mounted as files instead of being
+// written in the configuration
+func configSecret(key string) string {
+	if !viper.IsSet(key + "File") {
+		return viper.GetString(key)
+	}
 
-	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
-	pflag.Parse()
-	err := viper.BindPFlags(pflag.CommandLine)
+	file := viper.GetString(key + "File")
+	secret, err := ioutil.ReadFile(file) // #nosec this file comes from our config
 	if err != nil {
-		log.Fatalf("Could not bind process flags for commandline: %v", err)
+		log.Fatalf("Failed to read %sFile: %v", key, err)
 	}
 
-	action := viper.GetString("action")
-
-	return ClFlags{action: action}
-
+	return strings.TrimSpace(string(secret))
 }
 
 // configmongo populates a mongoConfig
 func configMongo() mongoConfig {
 	mongo := mongoConfig{}
+	mongo.uri = configSecret("mongo.uri")
 	mongo.authMechanism = viper.GetString("mongo.authMechanism")
+	mongo.authSource = viper.GetString("mongo.authSource")
+	mongo.replicaSet = viper.GetString("mongo.replicaSet")
+	mongo.readPreference = viper.GetString("mongo.readPreference")
 	mongo.host = viper.GetString("mongo.host")
 	mongo.port = viper.GetInt("mongo.port")
-	mongo.user = viper.GetString("mongo.user")
-	mongo.password = viper.GetString("mongo.password")
+	mongo.user = configSecret("mongo.user")
+	mongo.password = configSecret("mongo.password")
 
 	if viper.IsSet("mongo.cacert") {
 		mongo.caCert = viper.GetString("mongo.cacert")
 	}
+	if viper.IsSet("mongo.clientCert") {
+		mongo.clientCert = viper.GetString("mongo.clientCert")
+	}
+	if viper.IsSet("mongo.clientKey") {
+		mongo.clientKey = viper.GetString("mongo.clientKey")
+	}
+	mongo.tlsInsecure = viper.GetBool("mongo.tlsInsecure")
+	mongo.tls = viper.GetBool("mongo.tls") || mongo.caCert != "" || mongo.clientCert != "" || mongo.tlsInsecure
+
+	mongo.collections = defaultCollectionNames
+	for key, name := range map[string]*string{
+		"mongo.collections.users.database":     &mongo.collections.usersDatabase,
+		"mongo.collections.users.collection":   &mongo.collections.usersCollection,
+		"mongo.collections.folders.database":   &mongo.collections.foldersDatabase,
+		"mongo.collections.folders.collection": &mongo.collections.foldersCollection,
+		"mongo.collections.objects.database":   &mongo.collections.objectsDatabase,
+	} {
+		if viper.IsSet(key) {
+			*name = viper.GetString(key)
+		}
+	}
+
+	// X.509 authentication is used with a client certificate and no user
+	if mongo.authMechanism == "" && mongo.clientCert != "" && mongo.user == "" {
+		mongo.authMechanism = x509AuthMechanism
+	}
 
 	return mongo
 }
@@ -82,7 +113,6 @@ func configS3() S3Config {
 
 	s3.Port = 443
 	s3.Region = "us-east-1"
-	s3.NonExistRetryTime = 2 * time.Minute
 
 	if viper.IsSet("s3.port") {
 		s3.Port = viper.GetInt("s3.port")
@@ -92,14 +122,16 @@ func configS3() S3Config {
 		s3.Region = viper.GetString("s3.region")
 	}
 
-	if viper.IsSet("s3.chunksize") {
-		s3.Chunksize = viper.GetInt("s3.chunksize") * 1024 * 1024
-	}
-
 	if viper.IsSet("s3.cacert") {
 		s3.Cacert = viper.GetString("s3.cacert")
 	}
 
+	if viper.IsSet("s3.nonExistRetryTime") {
+		s3.NonExistRetryTime = viper.GetDuration("s3.nonExistRetryTime")
+	}
+
+	s3.Paths = configPathMapping("s3")
+
 	return s3
 }
 
@@ -132,14 +164,43 @@ func configDatabase() (DBConfig, error) {
 		db.CACert = viper.GetString("db.cacert")
 	}
 
+	db.Paths = configPathMapping("db")
+
 	return db, nil
 }
 
+// configPathMapping reads the mapping of metadata file names to the paths
+// of a backend from <section>.pathPrefix and <section>.pathSuffix
+func configPathMapping(section string) pathMapping {
+	mapping, err := newPathMapping(viper.GetString(section+".pathPrefix"), viper.GetString(section+".pathSuffix"))
+	if err != nil {
+		log.Fatalf("Invalid %s path mapping: %v", section, err)
+	}
+
+	return mapping
+}
+
+// configC4GH populates a c4ghConfig, the key is optional
+func configC4GH() c4ghConfig {
+	c4gh := c4ghConfig{}
+
+	if viper.IsSet("c4gh.filepath") {
+		c4gh.filePath = viper.GetString("c4gh.filepath")
+	}
+
+	if viper.IsSet("c4gh.passphrase") {
+		c4gh.passphrase = viper.GetString("c4gh.passphrase")
+	}
+
+	return c4gh
+}
+
 func (c *Config) readConfig() {
 
 	c.mongo = configMongo()
 	c.s3 = configS3()
-	c.postgres, _ = configDatabase()
+	c.postgres, c.postgresErr = configDatabase()
+	c.c4gh = configC4GH()
 
 	if viper.IsSet("loglevel") {
 		stringLevel := viper.GetString("loglevel")
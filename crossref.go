@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"metadata-reviewer/main/render"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// crossRefStatus summarises the outcome of cross referencing one file
+type crossRefStatus string
+
+const (
+	statusOK       crossRefStatus = "ok"
+	statusMissing  crossRefStatus = "missing"
+	statusMismatch crossRefStatus = "mismatch"
+	statusOrphan   crossRefStatus = "orphan"
+	statusError    crossRefStatus = "error"
+)
+
+// checksumComparison is the outcome of comparing the checksum declared in
+// the metadata with the one computed by a backend
+type checksumComparison string
+
+const (
+	checksumMatch        checksumComparison = "match"
+	checksumMismatch     checksumComparison = "mismatch"
+	checksumIncomparable checksumComparison = "incomparable"
+	checksumUnverifiable checksumComparison = "unverifiable"
+)
+
+// errNotInOrder is returned by the cross reference commands when at
+// least one file could not be found, checked, has a different checksum or
+// is not referenced by the metadata
+var errNotInOrder = errors.New("not all files are in order")
+
+// CrossRefResult is the outcome of cross referencing one file from the
+// metadata with the SDA backends. The presence fields are nil when the
+// corresponding backend was not checked.
+type CrossRefResult struct {
+	FileName              string             `bson:"fileName"`
+	InboxKey              string             `bson:"inboxKey,omitempty"`
+	SubmissionPath        string             `bson:"submissionPath,omitempty"`
+	InMetadata            bool               `bson:"inMetadata"`
+	AccessionID           string             `bson:"accessionId,omitempty"`
+	Schema                string             `bson:"schema,omitempty"`
+	MetadataChecksum      string             `bson:"metadataChecksum"`
+	MetadataChecksumType  string             `bson:"metadataChecksumType"`
+	InInbox               *bool              `bson:"inInbox,omitempty"`
+	InboxSize             *int64             `bson:"inboxSize,omitempty"`
+	InboxETag             string             `bson:"inboxETag,omitempty"`
+	InboxComparison       checksumComparison `bson:"inboxComparison,omitempty"`
+	Crypt4GH              string             `bson:"crypt4gh,omitempty"`
+	ContentChecksum       string             `bson:"contentChecksum,omitempty"`
+	ContentComparison     checksumComparison `bson:"contentComparison,omitempty"`
+	InArchive             *bool              `bson:"inArchive,omitempty"`
+	DecryptedChecksum     string             `bson:"decryptedChecksum,omitempty"`
+	DecryptedChecksumType string             `bson:"decryptedChecksumType,omitempty"`
+	ArchiveComparison     checksumComparison `bson:"archiveComparison,omitempty"`
+	Ingestion             *IngestionStatus   `bson:"ingestion,omitempty"`
+	Status                crossRefStatus     `bson:"status"`
+	Error                 string             `bson:"error,omitempty"`
+}
+
+// newCrossRefResult returns a result for the given metadata file
+func newCrossRefResult(file metadataFile) CrossRefResult {
+	return CrossRefResult{
+		FileName:             file.FileName,
+		InMetadata:           true,
+		AccessionID:          file.AccessionID,
+		Schema:               file.Schema,
+		MetadataChecksum:     file.Checksum,
+		MetadataChecksumType: file.ChecksumMethod,
+		Status:               statusOK,
+	}
+}
+
+// checkInbox records whether the file of the result is in the inbox,
+// together with its size, its ETag and whether it is a Crypt4GH file
+func checkInbox(ctx context.Context, inbox *s3Backend, r *CrossRefResult, user User) {
+	key, err := inbox.ObjectKey(r.FileName, user)
+	if err != nil {
+		r.setError(err)
+
+		return
+	}
+	r.InboxKey = key
+
+	info, err := inbox.StatFile(ctx, key)
+	switch info.State {
+	case objectPresent:
+		r.setInbox(true)
+		r.setInboxObject(info)
+
+		state, err := inbox.Crypt4GHState(ctx, key, info.Size)
+		if err != nil {
+			log.Debugf("Error reading the header of %s: %s", key, err)
+			r.setError(err)
+
+			return
+		}
+		r.setCrypt4GH(state)
+	case objectAbsent:
+		r.setInbox(false)
+	default:
+		log.Debugf("Error accessing s3: %s", err)
+		r.setError(err)
+	}
+}
+
+// checkArchive records whether the files of the results have been
+// archived, where they are in the pipeline and compares the checksums of
+// the decrypted files with the metadata. The files are looked up by their
+// submission paths in batches of dbBatchSize, run with the worker pool.
+func checkArchive(ctx context.Context, pool workerPool, db Database, results []CrossRefResult, user User) error {
+	paths := make([]string, len(results))
+	for i := range results {
+		path, err := db.SubmissionPath(results[i].FileName, user)
+		if err != nil {
+			return err
+		}
+		paths[i] = path
+		results[i].SubmissionPath = path
+	}
+
+	batches := (len(paths) + dbBatchSize - 1) / dbBatchSize
+	statuses := make([]map[string]IngestionStatus, batches)
+	errs := make([]error, batches)
+	err := pool.forEach(ctx, batches, func(ctx context.Context, b int) {
+		end := (b + 1) * dbBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		statuses[b], errs[b] = db.GetFileStatuses(ctx, paths[b*dbBatchSize:end])
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range results {
+		status, ok := statuses[i/dbBatchSize][results[i].SubmissionPath]
+		results[i].setArchive(ok && archivedStatuses[status.Status])
+		if ok {
+			results[i].setIngestion(status)
+		}
+	}
+
+	return nil
+}
+
+// checkInboxFiles runs checkInbox for all results with the worker pool
+func checkInboxFiles(ctx context.Context, pool workerPool, inbox *s3Backend, results []CrossRefResult, user User) error {
+	return pool.forEach(ctx, len(results), func(ctx context.Context, i int) {
+		checkInbox(ctx, inbox, &results[i], user)
+	})
+}
+
+// setError records an error that prevented checking the file
+func (r *CrossRefResult) setError(err error) {
+	r.Status = statusError
+	r.Error = err.Error()
+}
+
+// setInbox records whether the file was found in the inbox
+func (r *CrossRefResult) setInbox(found bool) {
+	r.InInbox = &found
+	if !found && r.Status == statusOK {
+		r.Status = statusMissing
+	}
+}
+
+// setArchive records whether the file was found in the archive
+func (r *CrossRefResult) setArchive(found bool) {
+	r.InArchive = &found
+	if !found && r.Status == statusOK {
+		r.Status = statusMissing
+	}
+}
+
+// setDecryptedChecksum records the checksum of the decrypted archived file
+// and compares it with the one declared in the metadata
+func (r *CrossRefResult) setDecryptedChecksum(checksum, checksumType string) {
+	r.DecryptedChecksum = checksum
+	r.DecryptedChecksumType = checksumType
+	r.ArchiveComparison = compareChecksums(r.MetadataChecksum, r.MetadataChecksumType, checksum, checksumType)
+	if r.ArchiveComparison == checksumMismatch && r.Status == statusOK {
+		r.Status = statusMismatch
+	}
+}
+
+// setInboxObject records the size and ETag of the inbox object and
+// compares its checksum with the one declared in the metadata. The ETag and
+// the stored checksums of a Crypt4GH object are the ones of the encrypted
+// file, so such objects are unverifiable.
+func (r *CrossRefResult) setInboxObject(info objectInfo) {
+	r.InboxSize = &info.Size
+	r.InboxETag = info.ETag
+	r.InboxComparison = checksumUnverifiable
+	if !strings.HasSuffix(r.InboxKey, crypt4ghSuffix) {
+		r.InboxComparison = compareInboxChecksum(info, r.MetadataChecksum, r.MetadataChecksumType)
+	}
+	if r.InboxComparison == checksumMismatch && r.Status == statusOK {
+		r.Status = statusMismatch
+	}
+}
+
+// setCrypt4GH records whether the inbox object is a Crypt4GH file. The ETag
+// of a Crypt4GH object is the one of the encrypted file, so a mismatch of
+// the inbox checksum, the only one found before the archive is checked, is
+// dropped.
+func (r *CrossRefResult) setCrypt4GH(state string) {
+	r.Crypt4GH = state
+	if state != crypt4ghNo && r.InboxComparison == checksumMismatch {
+		r.InboxComparison = checksumUnverifiable
+		if r.Status == statusMismatch {
+			r.Status = statusOK
+		}
+	}
+	if state == crypt4ghInvalid && r.Status == statusOK {
+		r.Status = statusError
+		r.Error = "invalid crypt4gh header"
+	}
+}
+
+// setContentHashes records the checksum computed from the content of the
+// inbox object and compares it with the one declared in the metadata. The
+// declared checksum is the one of the plaintext, so encrypted Crypt4GH
+// files are unverifiable unless they were decrypted.
+func (r *CrossRefResult) setContentHashes(hashes contentHashes) {
+	r.setCrypt4GH(hashes.Crypt4GH)
+	if hashes.Crypt4GH != crypt4ghNo && !hashes.Decrypted {
+		r.ContentComparison = checksumUnverifiable
+
+		return
+	}
+
+	r.ContentChecksum = hashes.checksum(r.MetadataChecksumType)
+	r.ContentComparison = compareChecksums(r.MetadataChecksum, r.MetadataChecksumType, r.ContentChecksum, r.MetadataChecksumType)
+	if r.ContentComparison == checksumMismatch && r.Status == statusOK {
+		r.Status = statusMismatch
+	}
+}
+
+// compareInboxChecksum compares the metadata checksum with a checksum stored
+// with the inbox object or, for MD5, with the ETag of single part uploads.
+// The ETag of a multipart upload is not the MD5 of the object, so without a
+// stored checksum such objects are unverifiable.
+func compareInboxChecksum(info objectInfo, checksum, method string) checksumComparison {
+	method = normaliseChecksumMethod(method)
+	if stored, ok := info.Checksums[method]; ok {
+		return compareChecksums(checksum, method, stored, method)
+	}
+
+	if method != "md5" {
+		return checksumIncomparable
+	}
+	if info.multipart() {
+		return checksumUnverifiable
+	}
+
+	return compareChecksums(checksum, method, info.ETag, "md5")
+}
+
+// setIngestion records the ingestion status of the file, a file the
+// pipeline failed on is reported as an error with the last error message
+func (r *CrossRefResult) setIngestion(status IngestionStatus) {
+	r.Ingestion = &status
+	r.setDecryptedChecksum(status.DecryptedChecksum, status.DecryptedChecksumType)
+	if status.Status == "error" && r.Status != statusError {
+		r.Status = statusError
+		r.Error = "ingestion failed"
+		if n := len(status.Errors); n > 0 {
+			r.Error += ": " + status.Errors[n-1].Message
+		}
+	}
+}
+
+// normaliseChecksumMethod maps the different spellings of a checksum
+// algorithm, like MD5, md5 or SHA-256, to a single lower case name
+func normaliseChecksumMethod(method string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(method)))
+}
+
+// compareChecksums compares two hex encoded checksums, checksums computed
+// with different or unknown algorithms are incomparable
+func compareChecksums(checksum, method, otherChecksum, otherMethod string) checksumComparison {
+	method = normaliseChecksumMethod(method)
+	if method == "" || checksum == "" || otherChecksum == "" || method != normaliseChecksumMethod(otherMethod) {
+		return checksumIncomparable
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(checksum), strings.TrimSpace(otherChecksum)) {
+		return checksumMismatch
+	}
+
+	return checksumMatch
+}
+
+// orphanSet collects the files found in the inbox or the archive that are
+// not referenced by the metadata, by their name without the path mapping of
+// the backends
+type orphanSet map[string]*CrossRefResult
+
+// get returns the result of the named orphan, creating it if needed
+func (o orphanSet) get(name string) *CrossRefResult {
+	if r, ok := o[name]; ok {
+		return r
+	}
+	o[name] = &CrossRefResult{FileName: name, Status: statusOrphan}
+
+	return o[name]
+}
+
+// results returns the orphans sorted by name. Every orphan has been looked
+// for in the inbox, and in the archive when archiveChecked is set, so
+// presence that was not recorded means absence.
+func (o orphanSet) results(archiveChecked bool) []CrossRefResult {
+	names := make([]string, 0, len(o))
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]CrossRefResult, len(names))
+	for i, name := range names {
+		r := o[name]
+		if r.InInbox == nil {
+			r.setInbox(false)
+		}
+		if r.InArchive == nil && archiveChecked {
+			r.setArchive(false)
+		}
+		results[i] = *r
+	}
+
+	return results
+}
+
+func (r CrossRefResult) TableHeader() []string {
+	return []string{"FILE", "OBJECT", "METADATA CHECKSUM", "INBOX", "INBOX MATCH", "CRYPT4GH", "CONTENT MATCH", "ARCHIVE", "INGESTION", "DECRYPTED CHECKSUM", "ARCHIVE MATCH", "STATUS"}
+}
+
+func (r CrossRefResult) TableRow() []string {
+	status := string(r.Status)
+	if r.Error != "" {
+		status += ": " + r.Error
+	}
+
+	return []string{
+		r.FileName,
+		r.object(),
+		typedChecksum(r.MetadataChecksum, r.MetadataChecksumType),
+		presence(r.InInbox),
+		string(r.InboxComparison),
+		r.Crypt4GH,
+		string(r.ContentComparison),
+		presence(r.InArchive),
+		r.ingestionStatus(),
+		typedChecksum(r.DecryptedChecksum, r.DecryptedChecksumType),
+		string(r.ArchiveComparison),
+		status,
+	}
+}
+
+// object formats the metadata object listing the file for tables
+func (r CrossRefResult) object() string {
+	if !r.InMetadata {
+		return "-"
+	}
+
+	return r.Schema + ":" + r.AccessionID
+}
+
+// ingestionStatus formats the ingestion status and the number of errors
+// reported for the file for tables
+func (r CrossRefResult) ingestionStatus() string {
+	if r.Ingestion == nil {
+		return "-"
+	}
+	if n := len(r.Ingestion.Errors); n > 0 {
+		return fmt.Sprintf("%s (%d errors)", r.Ingestion.Status, n)
+	}
+
+	return r.Ingestion.Status
+}
+
+// typedChecksum formats a checksum prefixed by its algorithm for tables
+func typedChecksum(checksum, method string) string {
+	if checksum == "" || method == "" {
+		return checksum
+	}
+
+	return normaliseChecksumMethod(method) + ":" + checksum
+}
+
+// presence formats an optional presence flag for tables
+func presence(found *bool) string {
+	switch {
+	case found == nil:
+		return "-"
+	case *found:
+		return "yes"
+	default:
+		return "no"
+	}
+}
+
+// reportCrossRef prints the results in the output format of the command
+// and returns errNotInOrder if any file is not in order
+func reportCrossRef(a *app, results []CrossRefResult) error {
+	records := make([]render.Record, len(results))
+	counts := map[crossRefStatus]int{}
+	for i, r := range results {
+		records[i] = r
+		counts[r.Status]++
+	}
+
+	if err := render.Print(os.Stdout, a.output, records); err != nil {
+		return err
+	}
+
+	log.Infof("Cross reference done: %d files, %d ok, %d missing, %d mismatching, %d orphans, %d errors",
+		len(results), counts[statusOK], counts[statusMissing], counts[statusMismatch], counts[statusOrphan], counts[statusError])
+
+	if counts[statusOK] != len(results) {
+		return errNotInOrder
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNormaliseChecksumMethod(t *testing.T) {
+	tests := map[string]string{
+		"MD5":     "md5",
+		" md5 ":   "md5",
+		"SHA-256": "sha256",
+		"sha_256": "sha256",
+		"sha256":  "sha256",
+		"":        "",
+	}
+
+	for method, want := range tests {
+		if got := normaliseChecksumMethod(method); got != want {
+			t.Errorf("normaliseChecksumMethod(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestCompareChecksums(t *testing.T) {
+	tests := []struct {
+		name               string
+		checksum, method   string
+		other, otherMethod string
+		want               checksumComparison
+	}{
+		{"match", "abc", "md5", "abc", "md5", checksumMatch},
+		{"case and spelling", "ABC", "SHA-256", "abc ", "sha256", checksumMatch},
+		{"mismatch", "abc", "md5", "abd", "md5", checksumMismatch},
+		{"different algorithms", "abc", "md5", "abc", "sha256", checksumIncomparable},
+		{"no algorithm", "abc", "", "abc", "", checksumIncomparable},
+		{"no checksum", "", "md5", "abc", "md5", checksumIncomparable},
+		{"no other checksum", "abc", "md5", "", "md5", checksumIncomparable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := compareChecksums(test.checksum, test.method, test.other, test.otherMethod); got != test.want {
+				t.Errorf("compareChecksums = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompareInboxChecksum(t *testing.T) {
+	tests := []struct {
+		name             string
+		info             objectInfo
+		checksum, method string
+		want             checksumComparison
+	}{
+		{"etag match", objectInfo{ETag: "abc"}, "abc", "MD5", checksumMatch},
+		{"etag mismatch", objectInfo{ETag: "abd"}, "abc", "md5", checksumMismatch},
+		{"multipart etag", objectInfo{ETag: "abc-2"}, "abc", "md5", checksumUnverifiable},
+		{"stored checksum", objectInfo{ETag: "abc-2", Checksums: map[string]string{"md5": "abc"}}, "abc", "md5", checksumMatch},
+		{"stored sha256", objectInfo{ETag: "abc", Checksums: map[string]string{"sha256": "def"}}, "def", "SHA-256", checksumMatch},
+		{"no sha256", objectInfo{ETag: "abc"}, "def", "sha256", checksumIncomparable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := compareInboxChecksum(test.info, test.checksum, test.method); got != test.want {
+				t.Errorf("compareInboxChecksum = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetInboxObjectCrypt4GH(t *testing.T) {
+	r := CrossRefResult{InboxKey: "file.bam.c4gh", MetadataChecksum: "abc", MetadataChecksumType: "md5", Status: statusOK}
+	r.setInboxObject(objectInfo{State: objectPresent, ETag: "def"})
+
+	if r.InboxComparison != checksumUnverifiable || r.Status != statusOK {
+		t.Errorf("got %s and status %s for a crypt4gh object", r.InboxComparison, r.Status)
+	}
+}
+
+func TestSetCrypt4GH(t *testing.T) {
+	tests := []struct {
+		state      string
+		comparison checksumComparison
+		status     crossRefStatus
+	}{
+		{crypt4ghNo, checksumMismatch, statusMismatch},
+		{crypt4ghValid, checksumUnverifiable, statusOK},
+		{crypt4ghInvalid, checksumUnverifiable, statusError},
+	}
+
+	for _, test := range tests {
+		r := CrossRefResult{InboxKey: "file.bam", MetadataChecksum: "abc", MetadataChecksumType: "md5", Status: statusOK}
+		r.setInboxObject(objectInfo{State: objectPresent, ETag: "def"})
+		r.setCrypt4GH(test.state)
+
+		if r.Crypt4GH != test.state || r.InboxComparison != test.comparison || r.Status != test.status {
+			t.Errorf("%s: got %s, %s and status %s, want %s and status %s",
+				test.state, r.Crypt4GH, r.InboxComparison, r.Status, test.comparison, test.status)
+		}
+	}
+}
+
+// fakeDB answers the status lookups from statuses and records the batches
+// it is asked for
+type fakeDB struct {
+	statuses map[string]IngestionStatus
+	fail     string
+
+	mu      sync.Mutex
+	batches []string
+}
+
+func (f *fakeDB) GetFileStatuses(_ context.Context, paths []string) (map[string]IngestionStatus, error) {
+	f.mu.Lock()
+	f.batches = append(f.batches, strings.Join(paths, ","))
+	f.mu.Unlock()
+
+	found := map[string]IngestionStatus{}
+	for _, path := range paths {
+		if path == f.fail {
+			return nil, errors.New("connection reset")
+		}
+		if status, ok := f.statuses[path]; ok {
+			found[path] = status
+		}
+	}
+
+	return found, nil
+}
+
+func (f *fakeDB) GetUserFiles(context.Context, string) ([]IngestedFile, error) {
+	return nil, nil
+}
+
+func (f *fakeDB) SubmissionPath(fileName string, user User) (string, error) {
+	return user.ID + "/" + fileName, nil
+}
+
+func (f *fakeDB) FileName(path string, user User) (string, error) {
+	return strings.TrimPrefix(path, user.ID+"/"), nil
+}
+
+func (f *fakeDB) Close() {}
+
+func TestCheckArchive(t *testing.T) {
+	defer func(size int) { dbBatchSize = size }(dbBatchSize)
+	dbBatchSize = 2
+
+	db := &fakeDB{statuses: map[string]IngestionStatus{
+		"u/a.c4gh": {Status: "archived", DecryptedChecksum: "abc", DecryptedChecksumType: "md5"},
+		"u/b.c4gh": {Status: "error", Errors: []IngestionError{{Message: "first"}, {Message: "wrong key"}}},
+		"u/d.c4gh": {Status: "uploaded"},
+		"u/e.c4gh": {Status: "verified", DecryptedChecksum: "def", DecryptedChecksumType: "md5"},
+	}}
+	var results []CrossRefResult
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		results = append(results, newCrossRefResult(metadataFile{File: File{FileName: name + ".c4gh", Checksum: "abc", ChecksumMethod: "md5"}}))
+	}
+
+	if err := checkArchive(context.Background(), workerPool{concurrency: 2}, db, results, User{ID: "u"}); err != nil {
+		t.Fatalf("checkArchive returned %v", err)
+	}
+
+	sort.Strings(db.batches)
+	if got, want := fmt.Sprint(db.batches), "[u/a.c4gh,u/b.c4gh u/c.c4gh,u/d.c4gh u/e.c4gh]"; got != want {
+		t.Errorf("looked up the batches %s, want %s", got, want)
+	}
+
+	tests := []struct {
+		inArchive bool
+		ingestion string
+		status    crossRefStatus
+		err       string
+	}{
+		{true, "archived", statusOK, ""},
+		{false, "error", statusError, "ingestion failed: wrong key"},
+		{false, "", statusMissing, ""},
+		{false, "uploaded", statusMissing, ""},
+		{true, "verified", statusMismatch, ""},
+	}
+	for i, test := range tests {
+		r := results[i]
+		ingestion := ""
+		if r.Ingestion != nil {
+			ingestion = r.Ingestion.Status
+		}
+		if r.InArchive == nil || *r.InArchive != test.inArchive || ingestion != test.ingestion || r.Status != test.status || r.Error != test.err {
+			t.Errorf("%s: got in archive %v, ingestion %q, status %s and error %q, want %v, %q, %s and %q",
+				r.FileName, r.InArchive, ingestion, r.Status, r.Error, test.inArchive, test.ingestion, test.status, test.err)
+		}
+	}
+}
+
+func TestCheckArchiveFailedBatch(t *testing.T) {
+	defer func(size int) { dbBatchSize = size }(dbBatchSize)
+	dbBatchSize = 2
+
+	db := &fakeDB{fail: "u/c.c4gh"}
+	var results []CrossRefResult
+	for _, name := range []string{"a", "b", "c"} {
+		results = append(results, newCrossRefResult(metadataFile{File: File{FileName: name + ".c4gh"}}))
+	}
+
+	if err := checkArchive(context.Background(), workerPool{concurrency: 1}, db, results, User{ID: "u"}); err == nil {
+		t.Error("checkArchive ignored a failed batch")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The layout of Crypt4GH files follows the GA4GH Crypt4GH specification,
+// https://samtools.github.io/hts-specs/crypt4gh.pdf
+
+// crypt4ghMagic starts every Crypt4GH file
+const crypt4ghMagic = "crypt4gh"
+
+// crypt4ghVersion is the only version of the format there is
+const crypt4ghVersion = 1
+
+// crypt4ghSegmentSize is the size of the plaintext in a data segment
+const crypt4ghSegmentSize = 65536
+
+// crypt4ghMACSize is the size of the Poly1305 tag ending each segment
+const crypt4ghMACSize = 16
+
+// maxHeaderPackets and maxPacketSize bound what is read from a header, so
+// that a corrupt file cannot make us allocate unreasonable amounts of memory
+const (
+	maxHeaderPackets = 1024
+	maxPacketSize    = 1 << 20
+)
+
+// crypt4ghHeader holds the encrypted packets of a Crypt4GH header
+type crypt4ghHeader struct {
+	Version uint32
+	Packets [][]byte
+}
+
+// errNotCrypt4GH is returned when a stream does not start with the magic
+var errNotCrypt4GH = errors.New("not a crypt4gh file")
+
+// readCrypt4GHHeader reads the header from the start of r, leaving r at the
+// first data segment. errNotCrypt4GH is returned when the magic is missing,
+// any other error means the file claims to be Crypt4GH but is not valid.
+func readCrypt4GHHeader(r io.Reader) (crypt4ghHeader, error) {
+	header := crypt4ghHeader{}
+
+	var start [16]byte
+	if _, err := io.ReadFull(r, start[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return header, errNotCrypt4GH
+		}
+
+		return header, err
+	}
+	if string(start[:8]) != crypt4ghMagic {
+		return header, errNotCrypt4GH
+	}
+
+	header.Version = binary.LittleEndian.Uint32(start[8:12])
+	if header.Version != crypt4ghVersion {
+		return header, fmt.Errorf("unsupported crypt4gh version %d", header.Version)
+	}
+
+	count := binary.LittleEndian.Uint32(start[12:16])
+	if count == 0 || count > maxHeaderPackets {
+		return header, fmt.Errorf("invalid crypt4gh header packet count %d", count)
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return header, fmt.Errorf("failed to read crypt4gh header packet %d: %v", i, err)
+		}
+		// the length includes the four bytes of the length itself
+		if length <= 4 || length > maxPacketSize {
+			return header, fmt.Errorf("invalid crypt4gh header packet length %d", length)
+		}
+
+		packet := make([]byte, length-4)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return header, fmt.Errorf("failed to read crypt4gh header packet %d: %v", i, err)
+		}
+		header.Packets = append(header.Packets, packet)
+	}
+
+	return header, nil
+}
+
+// dataKeys decrypts the header packets meant for the reader with the given
+// private key and returns the data encryption keys they hold
+func (h crypt4ghHeader) dataKeys(privateKey [32]byte) ([][32]byte, error) {
+	publicKey, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][32]byte
+	for _, packet := range h.Packets {
+		// encryption method, writer public key and nonce
+		if len(packet) < 4+32+12 || binary.LittleEndian.Uint32(packet[:4]) != 0 {
+			continue
+		}
+		writerKey := packet[4:36]
+
+		// the shared key is the start of Blake2b(dh || reader pk || writer pk)
+		dh, err := curve25519.X25519(privateKey[:], writerKey)
+		if err != nil {
+			continue
+		}
+		sum := blake2b.Sum512(append(append(dh, publicKey...), writerKey...))
+
+		aead, err := chacha20poly1305.New(sum[:32])
+		if err != nil {
+			return nil, err
+		}
+		plain, err := aead.Open(nil, packet[36:48], packet[48:], nil)
+		if err != nil {
+			// the packet is encrypted for another reader
+			continue
+		}
+
+		if len(plain) < 4 {
+			return nil, errors.New("invalid crypt4gh header packet")
+		}
+		switch binary.LittleEndian.Uint32(plain[:4]) {
+		case 0:
+			if len(plain) != 4+4+32 || binary.LittleEndian.Uint32(plain[4:8]) != 0 {
+				return nil, errors.New("unsupported crypt4gh data encryption method")
+			}
+			var key [32]byte
+			copy(key[:], plain[8:])
+			keys = append(keys, key)
+		case 1:
+			return nil, errors.New("crypt4gh edit lists are not supported")
+		default:
+			return nil, errors.New("unknown crypt4gh header packet type")
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("the crypt4gh file is not encrypted for the configured key")
+	}
+
+	return keys, nil
+}
+
+// crypt4ghReader decrypts the data segments following a Crypt4GH header
+type crypt4ghReader struct {
+	source io.Reader
+	keys   [][32]byte
+	buffer bytes.Buffer
+	done   bool
+}
+
+// newCrypt4GHReader returns a reader of the plaintext of r, which must be
+// positioned after the header
+func newCrypt4GHReader(r io.Reader, keys [][32]byte) *crypt4ghReader {
+	return &crypt4ghReader{source: r, keys: keys}
+}
+
+func (c *crypt4ghReader) Read(p []byte) (int, error) {
+	for c.buffer.Len() == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.readSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.buffer.Read(p)
+}
+
+// readSegment decrypts the next data segment into the buffer
+func (c *crypt4ghReader) readSegment() error {
+	segment := make([]byte, chacha20poly1305.NonceSize+crypt4ghSegmentSize+crypt4ghMACSize)
+	n, err := io.ReadFull(c.source, segment)
+	switch {
+	case err == io.EOF:
+		c.done = true
+
+		return nil
+	case err == io.ErrUnexpectedEOF:
+		c.done = true
+	case err != nil:
+		return err
+	}
+	if n <= chacha20poly1305.NonceSize+crypt4ghMACSize {
+		return errors.New("truncated crypt4gh data segment")
+	}
+	segment = segment[:n]
+
+	for _, key := range c.keys {
+		aead, err := chacha20poly1305.New(key[:])
+		if err != nil {
+			return err
+		}
+		plain, err := aead.Open(nil, segment[:chacha20poly1305.NonceSize], segment[chacha20poly1305.NonceSize:], nil)
+		if err == nil {
+			c.buffer.Write(plain)
+
+			return nil
+		}
+	}
+
+	return errors.New("failed to decrypt crypt4gh data segment")
+}
+
+// readCrypt4GHPrivateKey reads a private key in the Crypt4GH key format,
+// either unprotected or protected by a passphrase with scrypt or pbkdf2
+func readCrypt4GHPrivateKey(path, passphrase string) ([32]byte, error) {
+	var key [32]byte
+
+	pem, err := ioutil.ReadFile(path) // #nosec this file comes from our config
+	if err != nil {
+		return key, err
+	}
+
+	var encoded strings.Builder
+	for _, line := range strings.Split(string(pem), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "-----") {
+			encoded.WriteString(line)
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return key, fmt.Errorf("failed to decode crypt4gh key %s: %v", path, err)
+	}
+
+	const keyMagic = "c4gh-v1"
+	if !bytes.HasPrefix(data, []byte(keyMagic)) {
+		return key, fmt.Errorf("%s is not a crypt4gh private key", path)
+	}
+	r := bytes.NewReader(data[len(keyMagic):])
+
+	kdf, err := readKeyString(r)
+	if err != nil {
+		return key, err
+	}
+	var rounds uint32
+	var salt []byte
+	if string(kdf) != "none" {
+		options, err := readKeyString(r)
+		if err != nil || len(options) < 4 {
+			return key, fmt.Errorf("invalid kdf options in crypt4gh key %s", path)
+		}
+		rounds = binary.BigEndian.Uint32(options[:4])
+		salt = options[4:]
+	}
+
+	cipher, err := readKeyString(r)
+	if err != nil {
+		return key, err
+	}
+	secret, err := readKeyString(r)
+	if err != nil {
+		return key, err
+	}
+
+	switch string(cipher) {
+	case "none":
+		if len(secret) != 32 {
+			return key, fmt.Errorf("invalid crypt4gh key %s", path)
+		}
+		copy(key[:], secret)
+
+		return key, nil
+	case "chacha20_poly1305":
+	default:
+		return key, fmt.Errorf("unsupported cipher %q in crypt4gh key %s", cipher, path)
+	}
+
+	var derived []byte
+	switch string(kdf) {
+	case "scrypt":
+		derived, err = scrypt.Key([]byte(passphrase), salt, 1<<14, 8, 1, 32)
+	case "pbkdf2_hmac_sha256":
+		derived = pbkdf2.Key([]byte(passphrase), salt, int(rounds), 32, sha256.New)
+	default:
+		return key, fmt.Errorf("unsupported kdf %q in crypt4gh key %s", kdf, path)
+	}
+	if err != nil {
+		return key, err
+	}
+
+	aead, err := chacha20poly1305.New(derived)
+	if err != nil {
+		return key, err
+	}
+	if len(secret) < chacha20poly1305.NonceSize {
+		return key, fmt.Errorf("invalid crypt4gh key %s", path)
+	}
+	plain, err := aead.Open(nil, secret[:chacha20poly1305.NonceSize], secret[chacha20poly1305.NonceSize:], nil)
+	if err != nil || len(plain) != 32 {
+		return key, fmt.Errorf("failed to unlock crypt4gh key %s, wrong passphrase?", path)
+	}
+	copy(key[:], plain)
+
+	return key, nil
+}
+
+// readKeyString reads a string prefixed by its big endian 16 bit length
+func readKeyString(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("invalid crypt4gh key: %v", err)
+	}
+
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return nil, fmt.Errorf("invalid crypt4gh key: %v", err)
+	}
+
+	return s, nil
+}
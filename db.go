@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	// Needed implicitly to enable Postgres driver
-	_ "github.com/lib/pq"
+	// Also registers the Postgres driver
+	"github.com/lib/pq"
 )
 
 // Database defines methods to be implemented by SQLdb
 type Database interface {
-	GetChecksum(file File) error
+	GetFileStatuses(ctx context.Context, paths []string) (map[string]IngestionStatus, error)
+	GetUserFiles(ctx context.Context, user string) ([]IngestedFile, error)
+	SubmissionPath(fileName string, user User) (string, error)
+	FileName(path string, user User) (string, error)
 	Close()
 }
 
@@ -21,6 +27,61 @@ type Database interface {
 type SQLdb struct {
 	DB       *sql.DB
 	ConnInfo string
+	Paths    pathMapping
+}
+
+// IngestedFile holds the archive information of a file in the database, the
+// checksum is the one of the decrypted file
+type IngestedFile struct {
+	Path         string
+	Status       string
+	Checksum     string
+	ChecksumType string
+}
+
+// IngestionStatus describes where a file is in the ingestion pipeline
+type IngestionStatus struct {
+	Status                string           `bson:"status"`
+	StableID              string           `bson:"stableId,omitempty"`
+	ArchivePath           string           `bson:"archivePath,omitempty"`
+	DecryptedChecksum     string           `bson:"decryptedChecksum,omitempty"`
+	DecryptedChecksumType string           `bson:"decryptedChecksumType,omitempty"`
+	CreatedAt             *time.Time       `bson:"createdAt,omitempty"`
+	UpdatedAt             *time.Time       `bson:"updatedAt,omitempty"`
+	Errors                []IngestionError `bson:"errors,omitempty"`
+}
+
+// IngestionError is an error reported by the pipeline for a file
+type IngestionError struct {
+	Type       string    `bson:"type"`
+	Message    string    `bson:"message"`
+	OccurredAt time.Time `bson:"occurredAt"`
+}
+
+// ingestionStatuses maps the status codes of local_ega.main to the steps of
+// the pipeline, unknown codes are reported in lower case
+var ingestionStatuses = map[string]string{
+	"INIT":         "uploaded",
+	"IN_INGESTION": "ingested",
+	"ARCHIVED":     "archived",
+	"COMPLETED":    "verified",
+	"READY":        "ready",
+	"ERROR":        "error",
+	"DISABLED":     "disabled",
+}
+
+// archivedStatuses are the steps of the pipeline at which a file is in the
+// archive
+var archivedStatuses = map[string]bool{"archived": true, "verified": true, "ready": true}
+
+// ingestionStatus maps a status code of local_ega.main to a step of the
+// pipeline
+func ingestionStatus(code string) string {
+	if s, ok := ingestionStatuses[code]; ok {
+		return s
+	}
+
+	return strings.ToLower(code)
 }
 
 // DBConfig stores information about the database backend
@@ -34,25 +95,21 @@ type DBConfig struct {
 	SslMode    string
 	ClientCert string
 	ClientKey  string
+	Paths      pathMapping
 }
 
 // dbRetryTimes is the number of times to retry the same function if it fails
 var dbRetryTimes = 8
 
-// dbReconnectTimeout is how long to try to re-establish a connection to the database
-var dbReconnectTimeout = 5 * time.Minute
-
-// dbReconnectSleep is how long to wait between attempts to connect to the database
-var dbReconnectSleep = 5 * time.Second
+// dbRetrySleep is how long to wait before retrying a failed query, the
+// connections of the pool are reopened by database/sql when needed
+var dbRetrySleep = time.Second
 
 // sqlOpen is an internal variable to ease testing
 var sqlOpen = sql.Open
 
-// logFatalf is an internal variable to ease testing
-var logFatalf = log.Fatalf
-
-// NewDB creates a new DB connection
-func NewDB(config DBConfig) (*SQLdb, error) {
+// NewDB creates a new DB connection, ctx bounds the first connection
+func NewDB(ctx context.Context, config DBConfig) (*SQLdb, error) {
 	connInfo := buildConnInfo(config)
 
 	log.Debugf("Connecting to DB %s:%d on database: %s with user: %s", config.Host, config.Port, config.Database, config.User)
@@ -61,16 +118,19 @@ func NewDB(config DBConfig) (*SQLdb, error) {
 		return nil, err
 	}
 
-	if err = db.Ping(); err != nil {
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+
 		return nil, err
 	}
 
-	return &SQLdb{DB: db, ConnInfo: connInfo}, nil
+	return &SQLdb{DB: db, ConnInfo: connInfo, Paths: config.Paths}, nil
 }
 
-// buildConnInfo builds a connection string for the database
+// buildConnInfo builds a connection string for the database. Sessions are
+// read only, so that no statement can change the database.
 func buildConnInfo(config DBConfig) string {
-	connInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+	connInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s default_transaction_read_only=on",
 		config.Host, config.Port, config.User, config.Password, config.Database, config.SslMode)
 
 	if config.SslMode == "disable" {
@@ -92,54 +152,226 @@ func buildConnInfo(config DBConfig) string {
 	return connInfo
 }
 
-// checkAndReconnectIfNeeded validates the current connection with a ping
-// and tries to reconnect if necessary
-func (dbs *SQLdb) checkAndReconnectIfNeeded() {
-	start := time.Now()
+// dbRetry calls query until it succeeds, at most dbRetryTimes times. It
+// stops waiting for the next attempt when ctx is done.
+func dbRetry(ctx context.Context, query func() error) error {
+	err := query()
+	for count := 1; err != nil && count < dbRetryTimes; count++ {
+		log.Debugf("Query failed, retrying: %v", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(dbRetrySleep):
+		}
+		err = query()
+	}
 
-	for dbs.DB.Ping() != nil {
-		log.Errorln("Database unreachable, reconnecting")
-		dbs.DB.Close()
+	return err
+}
+
+// dbBatchSize is the number of files looked up with a single query
+var dbBatchSize = 1000
+
+// GetFileStatuses retrieves the ingestion status of files together with the
+// errors reported for them, keyed by path. Files that are not in the
+// database are missing from the map. All paths are looked up with a single
+// query, callers split long lists into batches of dbBatchSize. Retries stop
+// when ctx is done.
+func (dbs *SQLdb) GetFileStatuses(ctx context.Context, paths []string) (map[string]IngestionStatus, error) {
+	var statuses map[string]IngestionStatus
+	err := dbRetry(ctx, func() (err error) {
+		statuses, err = dbs.getFileStatuses(ctx, paths)
+
+		return err
+	})
+
+	return statuses, err
+}
+
+// getFileStatuses is the actual function performing work for
+// GetFileStatuses
+func (dbs *SQLdb) getFileStatuses(ctx context.Context, paths []string) (map[string]IngestionStatus, error) {
+	db := dbs.DB
+	// a file uploaded again gets a new row, the latest one is the current
+	const query = "SELECT DISTINCT ON (submission_file_path) id, submission_file_path, status, " +
+		"COALESCE(stable_id, ''), COALESCE(archive_file_reference, ''), " +
+		"COALESCE(decrypted_file_checksum, ''), COALESCE(decrypted_file_checksum_type, ''), " +
+		"created_at, last_modified FROM local_ega.main WHERE submission_file_path = ANY($1) " +
+		"ORDER BY submission_file_path, created_at DESC"
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(paths))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := map[string]IngestionStatus{}
+	pathByID := map[int64]string{}
+	var ids []int64
+	for rows.Next() {
+		var (
+			id                   int64
+			path, code           string
+			createdAt, updatedAt sql.NullTime
+			status               IngestionStatus
+		)
+		if err := rows.Scan(&id, &path, &code, &status.StableID, &status.ArchivePath,
+			&status.DecryptedChecksum, &status.DecryptedChecksumType,
+			&createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
 
-		if time.Since(start) > dbReconnectTimeout {
-			logFatalf("Could not reconnect to failed database in reasonable time, giving up")
+		status.Status = ingestionStatus(code)
+		if createdAt.Valid {
+			status.CreatedAt = &createdAt.Time
+		}
+		if updatedAt.Valid {
+			status.UpdatedAt = &updatedAt.Time
 		}
-		time.Sleep(dbReconnectSleep)
-		log.Debugln("Reconnecting to DB")
-		dbs.DB, _ = sqlOpen("postgres", dbs.ConnInfo)
+
+		statuses[path] = status
+		pathByID[id] = path
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-}
+	if len(ids) == 0 {
+		return statuses, nil
+	}
 
-// GetChecksum retrieves the file header
-func (dbs *SQLdb) GetChecksum(file File) error {
-	var (
-		err   error = nil
-		count int   = 0
-	)
+	const errorQuery = "SELECT file_id, COALESCE(error_type, ''), COALESCE(msg, ''), occured_at " +
+		"FROM local_ega.main_errors WHERE file_id = ANY($1) ORDER BY occured_at"
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
-		err = dbs.getChecksum(file)
-		count++
+	errorRows, err := db.QueryContext(ctx, errorQuery, pq.Array(ids))
+	if err != nil {
+		return nil, err
 	}
-	return err
+	defer errorRows.Close()
+
+	for errorRows.Next() {
+		var (
+			id int64
+			e  IngestionError
+		)
+		if err := errorRows.Scan(&id, &e.Type, &e.Message, &e.OccurredAt); err != nil {
+			return nil, err
+		}
+		status := statuses[pathByID[id]]
+		status.Errors = append(status.Errors, e)
+		statuses[pathByID[id]] = status
+	}
+
+	return statuses, errorRows.Err()
 }
 
-// getChecksum is the actual function performing work for GetHeader
-func (dbs *SQLdb) getChecksum(file File) error {
-	dbs.checkAndReconnectIfNeeded()
+// GetUserFiles retrieves all files submitted by a user, retries stop when
+// ctx is done
+func (dbs *SQLdb) GetUserFiles(ctx context.Context, user string) ([]IngestedFile, error) {
+	var files []IngestedFile
+	err := dbRetry(ctx, func() (err error) {
+		files, err = dbs.getUserFiles(ctx, user)
+
+		return err
+	})
+
+	return files, err
+}
 
+// getUserFiles is the actual function performing work for GetUserFiles
+func (dbs *SQLdb) getUserFiles(ctx context.Context, user string) ([]IngestedFile, error) {
 	db := dbs.DB
-	const query = "SELECT archive_file_checksum, archive_file_checksum_type FROM local_ega.main WHERE submission_file_path =  $1"
+	// a file uploaded again gets a new row, the latest one is the current
+	const query = "SELECT DISTINCT ON (submission_file_path) submission_file_path, status, " +
+		"COALESCE(decrypted_file_checksum, ''), COALESCE(decrypted_file_checksum_type, '') " +
+		"FROM local_ega.main WHERE submission_user = $1 ORDER BY submission_file_path, created_at DESC"
+
+	rows, err := db.QueryContext(ctx, query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []IngestedFile
+	for rows.Next() {
+		var (
+			f    IngestedFile
+			code string
+		)
+		if err := rows.Scan(&f.Path, &code, &f.Checksum, &f.ChecksumType); err != nil {
+			return nil, err
+		}
+		f.Status = ingestionStatus(code)
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// SubmissionPath returns the submission_file_path of a file from the
+// metadata
+func (dbs *SQLdb) SubmissionPath(fileName string, user User) (string, error) {
+	return dbs.Paths.apply(fileName, user)
+}
+
+// FileName returns the name of the file with the given
+// submission_file_path, as it would be listed in the metadata
+func (dbs *SQLdb) FileName(path string, user User) (string, error) {
+	return dbs.Paths.unapply(path, user)
+}
 
-	var checksum, checksumType string
-	if err := db.QueryRow(query, file.FileName).Scan(&checksum, &checksumType); err != nil {
+// dbTables are the tables the tool reads
+var dbTables = []string{"local_ega.main", "local_ega.main_errors"}
+
+// CheckReadOnly makes sure the session is read only
+func (dbs *SQLdb) CheckReadOnly(ctx context.Context) error {
+	var readOnly string
+	if err := dbs.DB.QueryRowContext(ctx, "SHOW transaction_read_only").Scan(&readOnly); err != nil {
 		return err
 	}
+	if readOnly != "on" {
+		return errors.New("the database session is not read only")
+	}
 
 	return nil
 }
 
+// Privileges returns the privileges granted on the tables the tool reads,
+// as table: privileges
+func (dbs *SQLdb) Privileges(ctx context.Context) ([]string, error) {
+	const query = "SELECT COALESCE(string_agg(p, ', '), '') FROM " +
+		"unnest(ARRAY['SELECT', 'INSERT', 'UPDATE', 'DELETE', 'TRUNCATE']) AS p " +
+		"WHERE has_table_privilege($1, p)"
+
+	var privileges []string
+	for _, table := range dbTables {
+		var granted string
+		if err := dbs.DB.QueryRowContext(ctx, query, table).Scan(&granted); err != nil {
+			return nil, err
+		}
+		privileges = append(privileges, table+": "+granted)
+	}
+
+	return privileges, nil
+}
+
+// MissingTables returns the tables read by the tool that do not exist
+func (dbs *SQLdb) MissingTables(ctx context.Context) ([]string, error) {
+	var missing []string
+	for _, table := range dbTables {
+		var exists bool
+		if err := dbs.DB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, table)
+		}
+	}
+
+	return missing, nil
+}
+
 // Close terminates the connection to the database
 func (dbs *SQLdb) Close() {
 	db := dbs.DB
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetFileStatuses(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	created := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM local_ega.main WHERE").WithArgs(sqlmock.AnyArg()).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "submission_file_path", "status", "stable_id", "archive_file_reference",
+			"decrypted_file_checksum", "decrypted_file_checksum_type", "created_at", "last_modified"}).
+			AddRow(1, "u/a.c4gh", "ARCHIVED", "", "1", "abc", "md5", created, nil).
+			AddRow(2, "u/b.c4gh", "ERROR", "", "", "", "", created, created))
+	mock.ExpectQuery("FROM local_ega.main_errors").WithArgs(sqlmock.AnyArg()).WillReturnRows(
+		sqlmock.NewRows([]string{"file_id", "error_type", "msg", "occured_at"}).
+			AddRow(2, "decryption", "wrong key", created).
+			AddRow(2, "", "retried", created.Add(time.Hour)))
+
+	dbs := &SQLdb{DB: db}
+	statuses, err := dbs.getFileStatuses(context.Background(), []string{"u/a.c4gh", "u/b.c4gh", "u/c.c4gh"})
+	if err != nil {
+		t.Fatalf("getFileStatuses returned %v", err)
+	}
+
+	if len(statuses) != 2 {
+		t.Errorf("got %d statuses, want 2", len(statuses))
+	}
+	if a := statuses["u/a.c4gh"]; a.Status != "archived" || a.ArchivePath != "1" || a.UpdatedAt != nil || len(a.Errors) != 0 {
+		t.Errorf("got %+v for the archived file", a)
+	}
+	b := statuses["u/b.c4gh"]
+	if b.Status != "error" || len(b.Errors) != 2 || b.Errors[0].Message != "wrong key" || b.Errors[1].Message != "retried" {
+		t.Errorf("got %+v for the failed file", b)
+	}
+	if _, ok := statuses["u/c.c4gh"]; ok {
+		t.Error("got a status for a file that is not in the database")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetFileStatusesNoFiles(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("FROM local_ega.main WHERE").WithArgs(sqlmock.AnyArg()).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "submission_file_path", "status", "stable_id", "archive_file_reference",
+			"decrypted_file_checksum", "decrypted_file_checksum_type", "created_at", "last_modified"}))
+
+	dbs := &SQLdb{DB: db}
+	statuses, err := dbs.getFileStatuses(context.Background(), []string{"u/c.c4gh"})
+	if err != nil || len(statuses) != 0 {
+		t.Errorf("getFileStatuses returned %v and %v", statuses, err)
+	}
+
+	// the errors are not looked up without files
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"metadata-reviewer/main/render"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// errChecksFailed is returned when at least one doctor check failed
+var errChecksFailed = errors.New("some checks failed")
+
+// Results of the doctor checks
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// diagnosis is the result of one doctor check
+type diagnosis struct {
+	Backend string `bson:"backend"`
+	Check   string `bson:"check"`
+	Result  string `bson:"result"`
+	Details string `bson:"details,omitempty"`
+}
+
+func (d diagnosis) TableHeader() []string {
+	return []string{"BACKEND", "CHECK", "RESULT", "DETAILS"}
+}
+
+func (d diagnosis) TableRow() []string {
+	// errors of the AWS SDK span several lines
+	return []string{d.Backend, d.Check, d.Result, strings.Join(strings.Fields(d.Details), " ")}
+}
+
+// doctorFlags returns the flags of the doctor command
+func doctorFlags() *pflag.FlagSet {
+	flags := addOutputFlag(pflag.NewFlagSet("doctor", pflag.ContinueOnError))
+	flags.Duration("backend-timeout", 10*time.Second, "timeout of each check")
+
+	return flags
+}
+
+// doctor runs the checks of the backends one after the other
+type doctor struct {
+	ctx     context.Context
+	timeout time.Duration
+	results []diagnosis
+}
+
+// check runs f with the timeout of the doctor and records its result, the
+// hint is added to the error to tell how to fix it. It returns true if the
+// check passed.
+func (d *doctor) check(backend, name, hint string, f func(ctx context.Context) (string, error)) bool {
+	ctx, cancel := context.WithTimeout(d.ctx, d.timeout)
+	defer cancel()
+
+	log.Debugf("Checking %s: %s", backend, name)
+	details, err := f(ctx)
+	if err != nil {
+		d.results = append(d.results, diagnosis{Backend: backend, Check: name, Result: checkFail, Details: fmt.Sprintf("%v. %s", err, hint)})
+
+		return false
+	}
+	d.results = append(d.results, diagnosis{Backend: backend, Check: name, Result: checkPass, Details: details})
+
+	return true
+}
+
+// skip records the checks that cannot run because an earlier one failed
+func (d *doctor) skip(backend string, reason string, names ...string) {
+	for _, name := range names {
+		d.results = append(d.results, diagnosis{Backend: backend, Check: name, Result: checkSkip, Details: reason})
+	}
+}
+
+// runDoctor checks the configuration and the connection of every backend
+// and prints the result of each check
+func runDoctor(a *app) error {
+	timeout, _ := a.flags.GetDuration("backend-timeout")
+	d := &doctor{ctx: a.ctx, timeout: timeout}
+
+	d.checkMetadataStore(a.conf.mongo)
+	d.checkInbox(a.conf.s3)
+	d.checkDatabase(a.conf.postgres, a.conf.postgresErr)
+
+	records := make([]render.Record, len(d.results))
+	failed := 0
+	for i, r := range d.results {
+		records[i] = r
+		if r.Result == checkFail {
+			failed++
+		}
+	}
+
+	if err := render.Print(os.Stdout, a.output, records); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", errChecksFailed, failed, len(d.results))
+	}
+
+	return nil
+}
+
+// checkMetadataStore checks the TLS material of the metadata store, the
+// connection and that the collections of the metadata submitter exist
+func (d *doctor) checkMetadataStore(conf mongoConfig) {
+	const backend = "metadata store"
+
+	if conf.tls {
+		ok := d.check(backend, "tls material", "Check mongo.cacert, mongo.clientCert and mongo.clientKey", func(ctx context.Context) (string, error) {
+			if conf.caCert != "" {
+				if err := checkCAFile(conf.caCert); err != nil {
+					return "", err
+				}
+			}
+			if conf.clientCert != "" || conf.clientKey != "" {
+				return checkKeyPair(conf.clientCert, conf.clientKey)
+			}
+
+			return "", nil
+		})
+		if !ok {
+			d.skip(backend, "the TLS material is invalid", "connection", "collections")
+
+			return
+		}
+	}
+
+	var client *mongoClient
+	ok := d.check(backend, "connection", "Check mongo.uri or mongo.host and mongo.port, and the credentials, and that the server is reachable", func(ctx context.Context) (string, error) {
+		c, err := newMongoClient(conf)
+		if err != nil {
+			return "", err
+		}
+		if err := c.connectToMongo(ctx); err != nil {
+			return "", err
+		}
+		client = c
+
+		return conf.address(), nil
+	})
+	if !ok {
+		d.skip(backend, "no connection", "collections")
+
+		return
+	}
+	defer func() {
+		if err := client.disconnectFromMongo(context.Background()); err != nil {
+			log.Warnf("Failed to disconnect from the metadata store: %v", err)
+		}
+	}()
+
+	d.check(backend, "collections", "Check mongo.collections and that this is the metadata store of the metadata submitter", func(ctx context.Context) (string, error) {
+		names := client.names
+		var missing []string
+		for _, c := range [][2]string{{names.usersDatabase, names.usersCollection}, {names.foldersDatabase, names.foldersCollection}} {
+			exists, err := client.hasCollection(ctx, c[0], c[1])
+			if err != nil {
+				return "", err
+			}
+			if !exists {
+				missing = append(missing, c[0]+"."+c[1])
+			}
+		}
+
+		schemas, err := client.getSchemas(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(schemas) == 0 {
+			missing = append(missing, names.objectsDatabase+".*")
+		}
+
+		if len(missing) > 0 {
+			return "", fmt.Errorf("missing collections %s", strings.Join(missing, ", "))
+		}
+
+		return fmt.Sprintf("%d metadata schemas", len(schemas)), nil
+	})
+}
+
+// checkInbox checks the TLS material of the inbox and that the bucket can
+// be listed
+func (d *doctor) checkInbox(conf S3Config) {
+	const backend = "inbox"
+
+	if conf.Cacert != "" {
+		ok := d.check(backend, "tls material", "Check s3.cacert", func(ctx context.Context) (string, error) {
+			return "", checkCAFile(conf.Cacert)
+		})
+		if !ok {
+			d.skip(backend, "the TLS material is invalid", "bucket", "listing")
+
+			return
+		}
+	}
+
+	var inbox *s3Backend
+	ok := d.check(backend, "bucket", "Check s3.url, s3.port, s3.bucket and the access keys, the bucket is never created by this tool", func(ctx context.Context) (string, error) {
+		sb, err := newS3Backend(ctx, conf)
+		if err != nil {
+			return "", err
+		}
+		inbox = sb
+
+		return fmt.Sprintf("%s:%d/%s", conf.URL, conf.Port, conf.Bucket), nil
+	})
+	if !ok {
+		d.skip(backend, "the bucket is not accessible", "listing")
+
+		return
+	}
+
+	d.check(backend, "listing", "Check that the access key may list the bucket", func(ctx context.Context) (string, error) {
+		return "", inbox.CheckList(ctx)
+	})
+}
+
+// checkDatabase checks the configuration and TLS material of the database,
+// the connection, that the session is read only and that the tables exist
+func (d *doctor) checkDatabase(conf DBConfig, confErr error) {
+	const backend = "database"
+
+	ok := d.check(backend, "configuration", "Fix the db section of the configuration", func(ctx context.Context) (string, error) {
+		return "", confErr
+	})
+	if !ok {
+		d.skip(backend, "the configuration is invalid", "connection", "read only", "tables")
+
+		return
+	}
+
+	if conf.SslMode != "disable" && (conf.CACert != "" || conf.ClientCert != "" || conf.ClientKey != "") {
+		ok := d.check(backend, "tls material", "Check db.cacert, db.clientCert and db.clientKey", func(ctx context.Context) (string, error) {
+			if conf.CACert != "" {
+				if err := checkCAFile(conf.CACert); err != nil {
+					return "", err
+				}
+			}
+			if conf.ClientCert != "" || conf.ClientKey != "" {
+				return checkKeyPair(conf.ClientCert, conf.ClientKey)
+			}
+
+			return "", nil
+		})
+		if !ok {
+			d.skip(backend, "the TLS material is invalid", "connection", "read only", "tables")
+
+			return
+		}
+	}
+
+	var db *SQLdb
+	ok = d.check(backend, "connection", "Check db.host, db.port, db.database, the credentials and db.sslmode", func(ctx context.Context) (string, error) {
+		sqlDB, err := NewDB(ctx, conf)
+		if err != nil {
+			return "", err
+		}
+		db = sqlDB
+
+		return fmt.Sprintf("%s:%d/%s", conf.Host, conf.Port, conf.Database), nil
+	})
+	if !ok {
+		d.skip(backend, "no connection", "read only", "tables")
+
+		return
+	}
+	defer db.Close()
+
+	d.check(backend, "read only", "Check that the server accepts default_transaction_read_only", func(ctx context.Context) (string, error) {
+		return "", db.CheckReadOnly(ctx)
+	})
+
+	d.check(backend, "tables", "Check that this is the database of the SDA pipeline", func(ctx context.Context) (string, error) {
+		missing, err := db.MissingTables(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(missing) > 0 {
+			return "", fmt.Errorf("missing tables %s", strings.Join(missing, ", "))
+		}
+
+		return strings.Join(dbTables, ", "), nil
+	})
+}
+
+// checkCAFile makes sure a CA file is readable and holds certificates
+func checkCAFile(path string) error {
+	pem, err := ioutil.ReadFile(path) // #nosec this file comes from our config
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s holds no PEM certificate", path)
+	}
+
+	return nil
+}
+
+// checkKeyPair makes sure a client certificate and its key match and that
+// the certificate is valid now, it returns the subject of the certificate
+func checkKeyPair(certFile, keyFile string) (string, error) {
+	if certFile == "" || keyFile == "" {
+		return "", errors.New("both a client certificate and its key are needed")
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		return "", fmt.Errorf("the client certificate %s is not valid before %s", certFile, cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		return "", fmt.Errorf("the client certificate %s expired on %s", certFile, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return "client certificate " + cert.Subject.String(), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"gopkg.in/square/go-jose.v2/json"
+)
+
+// defaultFilterFile is read when it exists and neither a filter file nor
+// an id is given
+const defaultFilterFile = "filter.json"
+
+// metadataFilter selects the user, folder and object to review
+type metadataFilter struct {
+	UserID      string `json:"userId"`
+	FolderID    string `json:"folderId"`
+	AccessionID string `json:"accessionId"`
+}
+
+// errEmptyFilter is returned when a filter lacks the ids a command needs
+var errEmptyFilter = errors.New("missing filter")
+
+// filterNeed tells which ids of the filter a command needs, the filter is
+// checked before connecting to any backend
+type filterNeed int
+
+const (
+	// needNothing is for the commands that take no filter or an optional one
+	needNothing filterNeed = iota
+	needAnyID
+	needOwner
+	needFolder
+)
+
+// check returns an error wrapping errEmptyFilter when the filter lacks the
+// needed ids
+func (n filterNeed) check(filter metadataFilter) error {
+	switch {
+	case n == needAnyID && filter == (metadataFilter{}):
+		return fmt.Errorf("%w: a user id, a folder id or an accession id is needed", errEmptyFilter)
+	case n == needOwner && filter.UserID == "" && filter.FolderID == "":
+		return fmt.Errorf("%w: a user id or a folder id is needed", errEmptyFilter)
+	case n == needFolder && filter.FolderID == "":
+		return fmt.Errorf("%w: a folder id is needed", errEmptyFilter)
+	}
+
+	return nil
+}
+
+// filterFlags returns a flag set for the named command holding the flags
+// that populate a metadataFilter
+func filterFlags(name string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.String("user-id", "", "id of the user to review")
+	flags.String("folder-id", "", "id of the submission folder to review")
+	flags.String("accession-id", "", "accession id of the metadata object to review")
+	flags.String("filter-file", "", "JSON file with the filter, defaults to "+defaultFilterFile+" if it exists and no id is given")
+
+	return flags
+}
+
+// filterIDFlags are the flags setting the ids of a metadataFilter
+var filterIDFlags = []string{"user-id", "folder-id", "accession-id"}
+
+// newMetadataFilter builds the filter from the filter file and the command
+// line, values given as flags override the ones from the file. The default
+// filter file is only read when no filter flag is given, so that the ids of
+// another submission never leak into a filter given on the command line.
+// Commands without filter flags get an empty filter.
+func newMetadataFilter(flags *pflag.FlagSet) (metadataFilter, error) {
+	filter := metadataFilter{}
+
+	if flags == nil || flags.Lookup("filter-file") == nil {
+		return filter, nil
+	}
+
+	filterFile, _ := flags.GetString("filter-file")
+	if !flags.Changed("filter-file") && !anyChanged(flags, filterIDFlags) {
+		if _, err := os.Stat(defaultFilterFile); err == nil {
+			log.Infof("Using the filter in %s", defaultFilterFile)
+			filterFile = defaultFilterFile
+		}
+	}
+
+	if filterFile != "" {
+		jsonFilter, err := ioutil.ReadFile(filterFile) // #nosec this file comes from the command line
+		if err != nil {
+			return filter, err
+		}
+		log.Debug(string(jsonFilter))
+
+		if err := json.Unmarshal(jsonFilter, &filter); err != nil {
+			return filter, err
+		}
+	}
+
+	if flags.Changed("user-id") {
+		filter.UserID, _ = flags.GetString("user-id")
+	}
+	if flags.Changed("folder-id") {
+		filter.FolderID, _ = flags.GetString("folder-id")
+	}
+	if flags.Changed("accession-id") {
+		filter.AccessionID, _ = flags.GetString("accession-id")
+	}
+
+	return filter, nil
+}
+
+// anyChanged returns true if any of the named flags was given
+func anyChanged(flags *pflag.FlagSet, names []string) bool {
+	for _, name := range names {
+		if flags.Changed(name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDir returns a directory removed at the end of the test
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "reviewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+// inDir runs the rest of the test in dir
+func inDir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestNewMetadataFilter(t *testing.T) {
+	dir := testDir(t)
+	inDir(t, dir)
+	if err := ioutil.WriteFile(defaultFilterFile, []byte(`{"userId": "default", "folderId": "defaultfolder"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other.json")
+	if err := ioutil.WriteFile(other, []byte(`{"userId": "other", "folderId": "otherfolder", "accessionId": "otherobject"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want metadataFilter
+	}{
+		{"default file", nil, metadataFilter{UserID: "default", FolderID: "defaultfolder"}},
+		{"flags only", []string{"--user-id", "someone"}, metadataFilter{UserID: "someone"}},
+		{"empty flag", []string{"--folder-id", ""}, metadataFilter{}},
+		{"file", []string{"--filter-file", other}, metadataFilter{UserID: "other", FolderID: "otherfolder", AccessionID: "otherobject"}},
+		{"flags override the file", []string{"--filter-file", other, "--folder-id", "folder"}, metadataFilter{UserID: "other", FolderID: "folder", AccessionID: "otherobject"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags := filterFlags("test")
+			if err := flags.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			got, err := newMetadataFilter(flags)
+			if err != nil {
+				t.Fatalf("newMetadataFilter returned %v", err)
+			}
+			if got != test.want {
+				t.Errorf("newMetadataFilter returned %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewMetadataFilterMissingFile(t *testing.T) {
+	flags := filterFlags("test")
+	if err := flags.Parse([]string{"--filter-file", filepath.Join(testDir(t), "missing.json")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newMetadataFilter(flags); err == nil {
+		t.Error("newMetadataFilter accepted a missing filter file")
+	}
+}
+
+func TestFilterNeedCheck(t *testing.T) {
+	user := metadataFilter{UserID: "user"}
+	folder := metadataFilter{FolderID: "folder"}
+	object := metadataFilter{AccessionID: "object"}
+
+	tests := []struct {
+		need   filterNeed
+		filter metadataFilter
+		ok     bool
+	}{
+		{needNothing, metadataFilter{}, true},
+		{needAnyID, metadataFilter{}, false},
+		{needAnyID, object, true},
+		{needOwner, object, false},
+		{needOwner, user, true},
+		{needOwner, folder, true},
+		{needFolder, user, false},
+		{needFolder, folder, true},
+	}
+
+	for _, test := range tests {
+		err := test.need.check(test.filter)
+		if (err == nil) != test.ok || (err != nil && !errors.Is(err, errEmptyFilter)) {
+			t.Errorf("check of %+v for need %d returned %v", test.filter, test.need, err)
+		}
+	}
+}
@@ -1,145 +1,154 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+
+	"metadata-reviewer/main/render"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/square/go-jose.v2/json"
+	"github.com/spf13/pflag"
 )
 
-// List all folder names together with their ids and user ids
-// JSON output on stdout
-
-type metadataFilter struct {
-	UserID      string `json:"userId"`
-	FolderID    string `json:"folderId"`
-	AccessionID string `json:"accessionId"`
-}
-
 func main() {
 
-	conf := NewConfig()
+	cmd, err := parseCommandLine(commands, os.Args[1:])
+	switch {
+	case err == pflag.ErrHelp:
+		os.Exit(0)
+	case err != nil:
+		os.Exit(2)
+	}
 
-	client, err := newMongoClient(conf.mongo)
+	// stdout is reserved for the results of the commands
+	log.SetOutput(os.Stderr)
 
+	output, err := newOutputFormat(cmd.flags)
 	if err != nil {
 		log.Error(err)
+		os.Exit(2)
 	}
 
-	inbox, err := newS3Backend(conf.s3)
+	metadataFilter, err := newMetadataFilter(cmd.flags)
 	if err != nil {
 		log.Error(err)
+		os.Exit(1)
 	}
-	log.Debug(inbox)
+	log.Debugf("Using filter %+v", metadataFilter)
 
-	jsonFilter, err := ioutil.ReadFile("filter.json")
-	if err != nil {
+	// the filter is checked before connecting to any backend
+	if err := cmd.filter.check(metadataFilter); err != nil {
 		log.Error(err)
+		os.Exit(2)
 	}
-	log.Debug(string(jsonFilter))
 
-	metadataFilter := metadataFilter{}
-	err = json.Unmarshal(jsonFilter, &metadataFilter)
-	if err != nil {
+	conf := NewConfig()
+
+	// Ctrl-C stops the running queries and lookups, the command then fails
+	ctx, cancel := context.WithCancel(context.Background())
+	runCtx, cancelRun := ctx, cancel
+	if timeout, _ := cmd.flags.GetDuration("timeout"); timeout > 0 {
+		runCtx, cancelRun = context.WithTimeout(ctx, timeout)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Warn("Interrupted, stopping")
+		cancel()
+	}()
+
+	err = run(runCtx, cmd, conf, metadataFilter, output)
+	cancelRun()
+	cancel()
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		log.Error("The command was interrupted")
+		os.Exit(1)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Error("The command did not finish within the timeout")
+		os.Exit(1)
+	case errors.Is(err, errNotInOrder):
+		log.Warn(err)
+		os.Exit(3)
+	case err != nil:
 		log.Error(err)
+		os.Exit(1)
 	}
+}
 
-	client.connectToMongo()
-
-	action := getCLflags().action
+// run connects to the backends needed by the command and runs it
+func run(ctx context.Context, cmd *command, conf *Config, filter metadataFilter, output render.Format) error {
+	a := &app{ctx: ctx, conf: conf, flags: cmd.flags, filter: filter, output: output}
 
-	switch action {
-	case "list-folders":
-		{
-			user := client.getUser("users", "user", metadataFilter.UserID)
-			client.getFolders("folders", "folder", user.Folders)
+	if cmd.backends&backendMetadata != 0 {
+		client, err := newMongoClient(conf.mongo)
+		if err != nil {
+			return err
 		}
-	case "list-objects":
-		{
-			var userFolders []string
-
-			if metadataFilter.FolderID != "" {
-				userFolders = append(userFolders, metadataFilter.FolderID)
-			} else {
-				userFolders = client.getUser("users", "user", metadataFilter.UserID).Folders
-			}
-
-			metadataCollections := client.getMetadataCollections("folders", "folder", userFolders)
-
-			var accessionIds []string
-			var schemas []string
-
-			if metadataFilter.AccessionID != "" {
-				accessionIds = append(accessionIds, metadataFilter.AccessionID)
-				_, schemas = getAccessionIdsAndSchemas(metadataCollections)
-			} else {
-				accessionIds, schemas = getAccessionIdsAndSchemas(metadataCollections)
+		if err := client.connectToMongo(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			// the command context may be done already
+			if err := client.disconnectFromMongo(context.Background()); err != nil {
+				log.Warnf("Failed to disconnect from the metadata store: %v", err)
 			}
+		}()
+		a.metadata = metadataRepository{mongo: client}
+
+		writable, err := client.writePrivileges(ctx)
+		switch {
+		case err != nil:
+			log.Warnf("Could not check the privileges in the metadata store: %v", err)
+		case len(writable) > 0:
+			log.Warnf("The metadata store user may write to %s, it is only read from", strings.Join(writable, "; "))
+		default:
+			log.Info("The metadata store user has no write privileges")
+		}
+	}
 
-			log.Debugf("Accession ids are: %s", strings.Join(accessionIds, " "))
-			log.Debugf("Schemas are: %s", strings.Join(schemas, " "))
+	if cmd.backends&backendInbox != 0 {
+		inbox, err := newS3Backend(ctx, conf.s3)
+		if err != nil {
+			return fmt.Errorf("failed to access the inbox: %v", err)
+		}
+		a.inbox = inbox
 
-			for _, sch := range schemas {
-				client.getMetadataObjects("objects", sch, accessionIds)
-			}
+		// the ACL is often not readable by the users of the inbox
+		if grants, err := inbox.Grants(ctx); err != nil {
+			log.Debugf("Could not read the ACL of the inbox bucket: %v", err)
+		} else {
+			log.Infof("Inbox bucket grants: %s", strings.Join(grants, "; "))
 		}
-	case "list-users":
-		{
-			client.getAllUsers("users", "user")
+	}
+
+	if cmd.backends&backendDatabase != 0 {
+		if conf.postgresErr != nil {
+			return conf.postgresErr
 		}
-	case "cross-ref-inbox":
-		{
-			log.Info("Cross reference started")
-			var analysisAccession string
-			if metadataFilter.AccessionID != "" {
-				analysisAccession = metadataFilter.AccessionID
-			} else if metadataFilter.FolderID != "" {
-				analysisAccession = client.getAccessionFromAnalysis("folders", "folder", metadataFilter.FolderID)
-			}
-			files := client.getFilesFromAnalysis("objects", "analysis", analysisAccession)
-
-			for _, file := range files {
-				exists, err := inbox.GetFileSize(file.FileName)
-				if err != nil {
-					log.Debugf("Error accessing s3: %s", err)
-					break
-				}
-				if exists {
-					log.Infof("File %s exists", file.FileName)
-				} else {
-					log.Infof("File %s does not exist", file.FileName)
-				}
-			}
+		db, err := NewDB(ctx, conf.postgres)
+		if err != nil {
+			return fmt.Errorf("failed to connect to the database: %v", err)
 		}
-	case "cross-ref-ingestion":
-		{
-			log.Info("Cross reference started")
-			postgres, err := NewDB(conf.postgres)
-			if err != nil {
-				log.Error(err)
-			}
+		defer db.Close()
+		a.db = db
 
-			var analysisAccession string
-			if metadataFilter.AccessionID != "" {
-				analysisAccession = metadataFilter.AccessionID
-			} else if metadataFilter.FolderID != "" {
-				analysisAccession = client.getAccessionFromAnalysis("folders", "folder", metadataFilter.FolderID)
-				log.Infof(analysisAccession)
-			}
-			files := client.getFilesFromAnalysis("objects", "analysis", analysisAccession)
-
-			for _, file := range files {
-				err := postgres.GetChecksum(file)
-				if err != nil {
-					log.Infof("File %s does not exists", file.FileName)
-				} else {
-					log.Infof("File %s exists", file.FileName)
-				}
-			}
+		if err := db.CheckReadOnly(ctx); err != nil {
+			return fmt.Errorf("refusing to use the database: %v", err)
+		}
+		if privileges, err := db.Privileges(ctx); err != nil {
+			log.Warnf("Could not check the privileges in the database: %v", err)
+		} else {
+			log.Infof("Database privileges of the read only session: %s", strings.Join(privileges, "; "))
 		}
 	}
 
-	client.disconnectFromMongo()
-
+	return cmd.run(a)
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,20 +16,64 @@ import (
 	bson "go.mongodb.org/mongo-driver/bson"
 	mongo "go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 // mongoConfig is a Struct that holds mongo config
 type mongoConfig struct {
-	authMechanism string
-	host          string
-	port          int
-	user          string
-	password      string
-	caCert        string
+	// uri takes precedence over host and port
+	uri            string
+	authMechanism  string
+	authSource     string
+	replicaSet     string
+	readPreference string
+	host           string
+	port           int
+	user           string
+	password       string
+	// TLS is used when tls is set or any certificate is given
+	tls         bool
+	caCert      string
+	clientCert  string
+	clientKey   string
+	tlsInsecure bool
+	collections collectionNames
+}
+
+// collectionNames holds where the metadata submitter keeps its documents,
+// the metadata objects are in one collection per schema of objectsDatabase
+type collectionNames struct {
+	usersDatabase     string
+	usersCollection   string
+	foldersDatabase   string
+	foldersCollection string
+	objectsDatabase   string
+}
+
+// defaultCollectionNames are the names used by the metadata submitter
+var defaultCollectionNames = collectionNames{
+	usersDatabase:     "users",
+	usersCollection:   "user",
+	foldersDatabase:   "folders",
+	foldersCollection: "folder",
+	objectsDatabase:   "objects",
 }
 
 type mongoClient struct {
 	client *mongo.Client
+	names  collectionNames
+}
+
+// readOnlyCollection holds the only collection operations the tool may
+// use, so that it cannot write to the metadata store by mistake
+type readOnlyCollection interface {
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+}
+
+// collection returns a collection of the metadata store for reading
+func (c mongoClient) collection(database string, collection string) readOnlyCollection {
+	return c.client.Database(database).Collection(collection)
 }
 
 type User struct {
@@ -53,172 +99,254 @@ type MetadataCollection struct {
 	MetadataObjects []MetadataObject `bson:"metadataObjects"`
 }
 
+// metadataFile is a file together with the metadata object listing it
+type metadataFile struct {
+	File
+	AccessionID string
+	Schema      string
+}
+
+// metadataDocument is a metadata object as stored in the objects database,
+// kept as raw BSON so that no field is lost or reordered when it is printed
+type metadataDocument struct {
+	schema string
+	raw    bson.Raw
+}
+
+// MarshalBSON returns the stored document
+func (d metadataDocument) MarshalBSON() ([]byte, error) {
+	return d.raw, nil
+}
+
 type File struct {
 	FileName       string `bson:"filename"`
 	ChecksumMethod string `bson:"checksumMethod"`
 	Checksum       string `bson:"checksum"`
 }
 
+// address returns the URI of the metadata store without credentials
+func (config mongoConfig) address() string {
+	if config.uri == "" {
+		return fmt.Sprintf("%s:%d", config.host, config.port)
+	}
+
+	scheme := strings.Index(config.uri, "://")
+	if scheme < 0 {
+		return config.uri
+	}
+	hosts := config.uri[scheme+3:]
+	if end := strings.IndexAny(hosts, "/?"); end >= 0 {
+		hosts = hosts[:end]
+	}
+	if at := strings.LastIndex(hosts, "@"); at >= 0 {
+		return config.uri[:scheme+3] + config.uri[scheme+3+at+1:]
+	}
+
+	return config.uri
+}
+
 func newMongoClient(config mongoConfig) (*mongoClient, error) {
 
 	opts := options.Client()
-	//tlsConf := transportConfigMongo(config)
-
-	//opts.SetTLSConfig(tlsConf)
+	if config.uri != "" {
+		opts.ApplyURI(config.uri)
+	} else {
+		opts.ApplyURI(fmt.Sprintf("%s:%d", config.host, config.port))
+	}
+	log.Debugf("Connecting to metadata store at %s", config.address())
 	opts.SetConnectTimeout(time.Second * 10)
-	opts.SetAuth(options.Credential{AuthMechanism: config.authMechanism, Username: config.user, Password: config.password})
-	opts.ApplyURI(fmt.Sprintf("%s:%d", config.host, config.port))
+
+	if config.replicaSet != "" {
+		opts.SetReplicaSet(config.replicaSet)
+	}
+
+	// reads only, they can be served by the secondaries unless the
+	// configuration or the URI says otherwise
+	switch {
+	case config.readPreference != "":
+		mode, err := readpref.ModeFromString(config.readPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mongo.readPreference: %v", err)
+		}
+		pref, err := readpref.New(mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mongo.readPreference: %v", err)
+		}
+		opts.SetReadPreference(pref)
+	case opts.ReadPreference == nil:
+		opts.SetReadPreference(readpref.SecondaryPreferred())
+	}
+
+	if config.tls {
+		tlsConf, err := transportConfigMongo(config)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConf)
+	}
+
+	// the configured credentials complete or override the ones of the URI
+	credential := options.Credential{}
+	if opts.Auth != nil {
+		credential = *opts.Auth
+	}
+	if config.authMechanism != "" {
+		credential.AuthMechanism = config.authMechanism
+	}
+	if config.authSource != "" {
+		credential.AuthSource = config.authSource
+	}
+	if config.user != "" {
+		credential.Username = config.user
+	}
+	if config.password != "" {
+		credential.Password = config.password
+		credential.PasswordSet = true
+	}
+	if credential.AuthMechanism == x509AuthMechanism {
+		// the user is taken from the subject of the client certificate
+		// when it is not given, a password is not allowed
+		credential.Password = ""
+		credential.PasswordSet = false
+	}
+	if credential.Username != "" || credential.AuthMechanism != "" {
+		opts.SetAuth(credential)
+	}
 
 	client, err := mongo.NewClient(opts)
 
-	return &mongoClient{client: client}, err
+	return &mongoClient{client: client, names: config.collections}, err
 }
 
-func (c mongoClient) connectToMongo() {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	err := c.client.Connect(ctx)
-	if err != nil {
-		log.Fatal(err)
+// connectToMongo connects to the metadata store and makes sure it answers
+func (c mongoClient) connectToMongo(ctx context.Context) error {
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := c.client.Connect(connectCtx); err != nil {
+		return fmt.Errorf("failed to connect to the metadata store: %v", err)
 	}
 
 	// Make sure the connection was established
-	err = c.client.Ping(context.TODO(), nil)
-	if err != nil {
-		log.Fatal(err)
+	if err := c.client.Ping(connectCtx, nil); err != nil {
+		return fmt.Errorf("failed to reach the metadata store: %v", err)
 	}
 
 	log.Debug("Connection established to metadata store")
 
+	return nil
 }
 
-func (c mongoClient) disconnectFromMongo() {
-	err := c.client.Disconnect(context.TODO())
-	if err != nil {
-		log.Fatal(err)
+func (c mongoClient) disconnectFromMongo(ctx context.Context) error {
+	if err := c.client.Disconnect(ctx); err != nil {
+		return err
 	}
 	log.Debug("Connection closed to metadata store")
 
+	return nil
 }
 
-func (c mongoClient) getFolders(database string, collection string, folderIds []string) {
+// findAll decodes all documents of a collection matching filter into result,
+// sorted by the sortBy field so that the results are the same on every run
+func (c mongoClient) findAll(ctx context.Context, database string, collection string, filter bson.M, sortBy string, result interface{}) error {
 
 	log.Debugf("Database %s is being queried using the %s collection", database, collection)
 
-	users := c.client.Database(database).Collection(collection)
-	filter := bson.M{"folderId": bson.M{"$in": folderIds}}
-	var folders []Folder
-	cursor, err := users.Find(context.TODO(), filter)
+	cursor, err := c.collection(database, collection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: sortBy, Value: 1}}))
 	if err != nil {
-		log.Error(err)
+		return fmt.Errorf("failed to query %s.%s: %v", database, collection, err)
 	}
-	err = cursor.All(context.TODO(), &folders)
-	if err != nil {
-		log.Error(err)
-	}
-	for _, obj := range folders {
-		out, err := bson.MarshalExtJSON(obj, false, false)
-		if err != nil {
-			log.Error(err)
-		}
-		fmt.Println(string(out))
-		fmt.Println(strings.Repeat("-", 10))
+	if err := cursor.All(ctx, result); err != nil {
+		return fmt.Errorf("failed to read %s.%s: %v", database, collection, err)
 	}
+
+	return nil
 }
 
-func (c mongoClient) getUser(database string, collection string, userID string) User {
+// findUser returns the user matching filter, describe tells which user is
+// looked for in the error when there is none
+func (c mongoClient) findUser(ctx context.Context, database string, collection string, filter bson.M, describe string) (User, error) {
 
 	log.Debugf("Database %s is being queried using the %s collection", database, collection)
 
-	filter := bson.M{"userId": userID}
-	users := c.client.Database(database).Collection(collection)
 	var user User
-	err := users.FindOne(context.TODO(), filter).Decode(&user)
-	if err != nil {
-		log.Error(err)
+	err := c.collection(database, collection).FindOne(ctx, filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, fmt.Errorf("no user found with %s", describe)
 	}
-	out, err := bson.MarshalExtJSON(user, false, false)
 	if err != nil {
-		log.Error(err)
+		return user, fmt.Errorf("failed to query %s.%s: %v", database, collection, err)
 	}
-	fmt.Println(string(out))
-	return user
 
+	return user, nil
 }
 
-func (c mongoClient) getAllUsers(database string, collection string) {
-
-	log.Debugf("Database %s is being queried using the %s collection", database, collection)
+func (c mongoClient) getFolders(ctx context.Context, folderIds []string) ([]Folder, error) {
+	var folders []Folder
+	err := c.findAll(ctx, c.names.foldersDatabase, c.names.foldersCollection, bson.M{"folderId": bson.M{"$in": folderIds}}, "folderId", &folders)
 
-	filter := bson.M{}
-	col := c.client.Database(database).Collection(collection)
-	var users []User
-	cursor, err := col.Find(context.TODO(), filter)
-	if err != nil {
-		log.Error(err)
-	}
-	err = cursor.All(context.TODO(), &users)
-	if err != nil {
-		log.Error(err)
-	}
-	for _, usr := range users {
-		out, err := bson.MarshalExtJSON(usr, false, false)
-		if err != nil {
-			log.Error(err)
-		}
-		fmt.Println(string(out))
-		fmt.Println(strings.Repeat("-", 10))
-	}
+	return folders, err
+}
 
+func (c mongoClient) getUser(ctx context.Context, userID string) (User, error) {
+	return c.findUser(ctx, c.names.usersDatabase, c.names.usersCollection, bson.M{"userId": userID}, "id "+userID)
 }
 
-func (c mongoClient) getMetadataObjects(database string, collection string, accessionIds []string) {
+func (c mongoClient) getFolderOwner(ctx context.Context, folderID string) (User, error) {
+	return c.findUser(ctx, c.names.usersDatabase, c.names.usersCollection, bson.M{"folders": folderID}, "folder "+folderID)
+}
 
+// getObjectFolder returns the id of the folder listing the metadata object
+// with the given accession id
+func (c mongoClient) getObjectFolder(ctx context.Context, accessionID string) (string, error) {
+	database, collection := c.names.foldersDatabase, c.names.foldersCollection
 	log.Debugf("Database %s is being queried using the %s collection", database, collection)
 
-	filter := bson.M{"accessionId": bson.M{"$in": accessionIds}}
-	users := c.client.Database(database).Collection(collection)
-	var objects []interface{}
-	cursor, err := users.Find(context.TODO(), filter)
-	if err != nil {
-		log.Error(err)
+	var folder MetadataCollection
+	err := c.collection(database, collection).FindOne(ctx, bson.M{"metadataObjects.accessionId": accessionID}).Decode(&folder)
+	if err == mongo.ErrNoDocuments {
+		return "", fmt.Errorf("no folder found listing the object %s", accessionID)
 	}
-	err = cursor.All(context.TODO(), &objects)
 	if err != nil {
-		log.Error(err)
-	}
-	for _, obj := range objects {
-		out, err := bson.MarshalExtJSON(obj, false, false)
-		if err != nil {
-			log.Error(err)
-		}
-		log.Infof("Objects found in collection %s", collection)
-		fmt.Println(string(out))
-		fmt.Println(strings.Repeat("-", 10))
+		return "", fmt.Errorf("failed to query %s.%s: %v", database, collection, err)
 	}
 
+	return folder.FolderID, nil
 }
 
-func (c mongoClient) getMetadataCollections(database string, collection string, folder []string) []MetadataCollection {
+func (c mongoClient) getAllUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.findAll(ctx, c.names.usersDatabase, c.names.usersCollection, bson.M{}, "userId", &users)
 
-	log.Debugf("Database %s is being queried using the %s collection", database, collection)
+	return users, err
+}
 
-	filter := bson.M{"folderId": bson.M{"$in": folder}}
-	users := c.client.Database(database).Collection(collection)
-	var mc []MetadataCollection
-	cursor, err := users.Find(context.TODO(), filter)
-	if err != nil {
-		log.Error(err)
+func (c mongoClient) getMetadataObjects(ctx context.Context, schema string, accessionIds []string) ([]metadataDocument, error) {
+	var objects []bson.Raw
+	if err := c.findAll(ctx, c.names.objectsDatabase, schema, bson.M{"accessionId": bson.M{"$in": accessionIds}}, "accessionId", &objects); err != nil {
+		return nil, err
 	}
-	err = cursor.All(context.TODO(), &mc)
-	if err != nil {
-		log.Error(err)
+	log.Debugf("%d objects found in collection %s", len(objects), schema)
+
+	documents := make([]metadataDocument, len(objects))
+	for i, obj := range objects {
+		documents[i] = metadataDocument{schema: schema, raw: obj}
 	}
-	return mc
 
+	return documents, nil
+}
+
+func (c mongoClient) getMetadataCollections(ctx context.Context, folder []string) ([]MetadataCollection, error) {
+	var mc []MetadataCollection
+	err := c.findAll(ctx, c.names.foldersDatabase, c.names.foldersCollection, bson.M{"folderId": bson.M{"$in": folder}}, "folderId", &mc)
+
+	return mc, err
 }
 
+// x509AuthMechanism authenticates with the TLS client certificate
+const x509AuthMechanism = "MONGODB-X509"
+
 // transportConfigMongo is a helper method to setup TLS for the Mongo client.
-func transportConfigMongo(config mongoConfig) *tls.Config {
+func transportConfigMongo(config mongoConfig) (*tls.Config, error) {
 	cfg := new(tls.Config)
 
 	// Enforce TLS1.2 or higher
@@ -233,70 +361,138 @@ func transportConfigMongo(config mongoConfig) *tls.Config {
 	cfg.RootCAs = systemCAs
 
 	if config.caCert != "" {
-		cacert, e := ioutil.ReadFile(config.caCert)
+		cacert, e := ioutil.ReadFile(config.caCert) // #nosec this file comes from our config
 		if e != nil {
-			log.Fatalf("failed to append %q to RootCAs: %v", cacert, e)
+			return nil, fmt.Errorf("failed to read mongo.cacert %s: %v", config.caCert, e)
 		}
 		if ok := cfg.RootCAs.AppendCertsFromPEM(cacert); !ok {
 			log.Debug("no certs appended, using system certs only")
 		}
 	}
 
-	return cfg
-}
+	if config.clientCert != "" || config.clientKey != "" {
+		if config.clientCert == "" || config.clientKey == "" {
+			return nil, errors.New("both mongo.clientCert and mongo.clientKey are needed for a client certificate")
+		}
+		cert, e := tls.LoadX509KeyPair(config.clientCert, config.clientKey)
+		if e != nil {
+			return nil, fmt.Errorf("failed to load the mongo client certificate: %v", e)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
 
-func (c mongoClient) getFilesFromAnalysis(database string, collection string, accessionID string) (files []File) {
+	if config.tlsInsecure {
+		log.Warn("The certificate of the metadata store is not verified")
+		cfg.InsecureSkipVerify = true // #nosec only meant for development setups
+	}
 
-	log.Debugf("Database %s is being queried using the %s collection", database, collection)
+	return cfg, nil
+}
 
-	filter := bson.M{"accessionId": accessionID}
-	client := c.client.Database(database).Collection(collection)
+func (c mongoClient) getFilesFromObjects(ctx context.Context, schema string, accessionIds []string) ([]metadataFile, error) {
 	objects := []MetadataObject{}
-	cursor, err := client.Find(context.TODO(), filter)
-	if err != nil {
-		log.Error(err)
-	}
-	err = cursor.All(context.TODO(), &objects)
-	if err != nil {
-		log.Error(err)
+	filter := bson.M{"accessionId": bson.M{"$in": accessionIds}, "files": bson.M{"$exists": true}}
+	if err := c.findAll(ctx, c.names.objectsDatabase, schema, filter, "accessionId", &objects); err != nil {
+		return nil, err
 	}
-	//log.Infof("Objects %s", objects)
 
+	var files []metadataFile
 	for _, obj := range objects {
+		log.Debugf("Object %s in collection %s lists %d files", obj.AccessionID, schema, len(obj.Files))
 		for _, file := range obj.Files {
-			files = append(files, file)
+			files = append(files, metadataFile{File: file, AccessionID: obj.AccessionID, Schema: schema})
 		}
 	}
 
-	return files
+	return files, nil
+}
 
+// getSchemas returns the schemas there are metadata objects for, that is
+// the collections of the objects database
+func (c mongoClient) getSchemas(ctx context.Context) ([]string, error) {
+	return c.getCollectionNames(ctx, c.names.objectsDatabase, bson.M{})
 }
 
-func (c mongoClient) getAccessionFromAnalysis(database string, collection string, folderID string) string {
-	var accession string
-	log.Debugf("Database %s is being queried using the %s collection", database, collection)
+// hasCollection tells whether a collection exists
+func (c mongoClient) hasCollection(ctx context.Context, database string, collection string) (bool, error) {
+	names, err := c.getCollectionNames(ctx, database, bson.M{"name": collection})
+
+	return len(names) > 0, err
+}
 
-	filter := bson.M{"folderId": folderID}
-	client := c.client.Database(database).Collection(collection)
-	objects := []MetadataCollection{}
-	//ar objects []interface{}
-	cursor, err := client.Find(context.TODO(), filter)
+func (c mongoClient) getCollectionNames(ctx context.Context, database string, filter bson.M) ([]string, error) {
+
+	log.Debugf("Collections of database %s are being listed", database)
+
+	names, err := c.client.Database(database).ListCollectionNames(ctx, filter)
 	if err != nil {
-		log.Error(err)
+		return nil, fmt.Errorf("failed to list the collections of %s: %v", database, err)
 	}
-	err = cursor.All(context.TODO(), &objects)
-	if err != nil {
-		log.Error(err)
+	// the server lists the collections in no particular order
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// mongoWriteActions are the privilege actions that allow changing data
+var mongoWriteActions = map[string]bool{
+	"insert":           true,
+	"update":           true,
+	"remove":           true,
+	"createCollection": true,
+	"dropCollection":   true,
+	"createIndex":      true,
+	"dropIndex":        true,
+	"dropDatabase":     true,
+	"collMod":          true,
+	"renameCollection": true,
+}
+
+// writePrivileges returns the resources the authenticated user may write
+// to, as database.collection: actions
+func (c mongoClient) writePrivileges(ctx context.Context) ([]string, error) {
+	var status struct {
+		AuthInfo struct {
+			Privileges []struct {
+				Resource struct {
+					DB         string `bson:"db"`
+					Collection string `bson:"collection"`
+					Cluster    bool   `bson:"cluster"`
+				} `bson:"resource"`
+				Actions []string `bson:"actions"`
+			} `bson:"authenticatedUserPrivileges"`
+		} `bson:"authInfo"`
 	}
 
-	for _, obj := range objects {
-		for _, schema := range obj.MetadataObjects {
-			if schema.Schema == "analysis" {
-				accession = schema.AccessionID
+	command := bson.D{{Key: "connectionStatus", Value: 1}, {Key: "showPrivileges", Value: true}}
+	if err := c.client.Database("admin").RunCommand(ctx, command).Decode(&status); err != nil {
+		return nil, err
+	}
+
+	var privileges []string
+	for _, p := range status.AuthInfo.Privileges {
+		var actions []string
+		for _, action := range p.Actions {
+			if mongoWriteActions[action] {
+				actions = append(actions, action)
 			}
 		}
-	}
+		if len(actions) == 0 {
+			continue
+		}
 
-	return accession
+		resource := "cluster"
+		if !p.Resource.Cluster {
+			resource = p.Resource.DB + "." + p.Resource.Collection
+			if p.Resource.DB == "" {
+				resource = "*" + resource
+			}
+			if p.Resource.Collection == "" {
+				resource += "*"
+			}
+		}
+		privileges = append(privileges, resource+": "+strings.Join(actions, ", "))
+	}
 
+	return privileges, nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"metadata-reviewer/main/render"
+
+	"github.com/spf13/pflag"
+)
+
+// addOutputFlag adds the --output flag to the flags of a command
+func addOutputFlag(flags *pflag.FlagSet) *pflag.FlagSet {
+	names := make([]string, len(render.Formats))
+	for i, f := range render.Formats {
+		names[i] = string(f)
+	}
+	flags.StringP("output", "o", string(render.Table), "output format, one of "+strings.Join(names, "|"))
+
+	return flags
+}
+
+// newOutputFormat returns the format given with the --output flag,
+// commands without the flag get the table format
+func newOutputFormat(flags *pflag.FlagSet) (render.Format, error) {
+	if flags == nil || flags.Lookup("output") == nil {
+		return render.Table, nil
+	}
+
+	value, _ := flags.GetString("output")
+
+	return render.ParseFormat(value)
+}
+
+func (u User) TableHeader() []string {
+	return []string{"USER ID", "NAME", "EPPN", "FOLDERS"}
+}
+
+func (u User) TableRow() []string {
+	return []string{u.ID, u.Name, u.Eppn, strconv.Itoa(len(u.Folders))}
+}
+
+func (f Folder) TableHeader() []string {
+	return []string{"FOLDER ID", "NAME"}
+}
+
+func (f Folder) TableRow() []string {
+	return []string{f.ID, f.Name}
+}
+
+func (o inboxObject) TableHeader() []string {
+	return []string{"KEY", "SIZE", "LAST MODIFIED"}
+}
+
+func (o inboxObject) TableRow() []string {
+	return []string{o.Key, strconv.FormatInt(o.Size, 10), o.LastModified.Format(time.RFC3339)}
+}
+
+func (d metadataDocument) TableHeader() []string {
+	return []string{"ACCESSION ID", "SCHEMA", "ALIAS", "TITLE"}
+}
+
+func (d metadataDocument) TableRow() []string {
+	lookup := func(key string) string {
+		value, _ := d.raw.Lookup(key).StringValueOK()
+
+		return value
+	}
+
+	return []string{lookup("accessionId"), d.schema, lookup("alias"), lookup("title")}
+}
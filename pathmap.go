@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// pathMapping translates the file names in the metadata to the paths used
+// by a backend. The prefix is a template executed with a pathUser, so that
+// it can hold the inbox directory of the submitter, and the suffix is
+// appended when the name does not already end with it.
+type pathMapping struct {
+	prefix *template.Template
+	suffix string
+}
+
+// pathUser holds the user fields available to the prefix templates
+type pathUser struct {
+	UserID string
+	Eppn   string
+	Name   string
+	// Username is the eppn with @ replaced by _, as used for the inbox
+	// directories of the SDA
+	Username string
+}
+
+// repeatedSlashes matches the slashes that are collapsed when mapping
+var repeatedSlashes = regexp.MustCompile("/{2,}")
+
+// newPathMapping parses the prefix template of a mapping
+func newPathMapping(prefix, suffix string) (pathMapping, error) {
+	mapping := pathMapping{suffix: suffix}
+	if prefix == "" {
+		return mapping, nil
+	}
+
+	tmpl, err := template.New("prefix").Option("missingkey=error").Parse(prefix)
+	if err != nil {
+		return mapping, fmt.Errorf("invalid path prefix %q: %v", prefix, err)
+	}
+	mapping.prefix = tmpl
+
+	return mapping, nil
+}
+
+// userPrefix returns the prefix of the paths of the files submitted by
+// user, without leading or repeated slashes
+func (m pathMapping) userPrefix(user User) (string, error) {
+	if m.prefix == nil {
+		return "", nil
+	}
+
+	var prefix bytes.Buffer
+	err := m.prefix.Execute(&prefix, pathUser{
+		UserID:   user.ID,
+		Eppn:     user.Eppn,
+		Name:     user.Name,
+		Username: strings.Replace(user.Eppn, "@", "_", 1)})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimLeft(repeatedSlashes.ReplaceAllString(prefix.String(), "/"), "/"), nil
+}
+
+// apply returns the backend path of a file submitted by user. Leading
+// slashes are removed and repeated slashes are collapsed.
+func (m pathMapping) apply(fileName string, user User) (string, error) {
+	prefix, err := m.userPrefix(user)
+	if err != nil {
+		return "", fmt.Errorf("failed to map %s: %v", fileName, err)
+	}
+	name := prefix + strings.TrimLeft(fileName, "/")
+
+	if m.suffix != "" && !strings.HasSuffix(name, m.suffix) {
+		name += m.suffix
+	}
+
+	return strings.TrimLeft(repeatedSlashes.ReplaceAllString(name, "/"), "/"), nil
+}
+
+// unapply returns the name of the file at a backend path of user, the path
+// without the prefix and the suffix of the mapping when it has them, so
+// that the paths of a file in different backends give the same name
+func (m pathMapping) unapply(path string, user User) (string, error) {
+	prefix, err := m.userPrefix(user)
+	if err != nil {
+		return "", fmt.Errorf("failed to map %s: %v", path, err)
+	}
+	name := strings.TrimPrefix(strings.TrimLeft(path, "/"), prefix)
+
+	return strings.TrimSuffix(name, m.suffix), nil
+}
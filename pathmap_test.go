@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestPathMappingApply(t *testing.T) {
+	user := User{ID: "u1", Name: "Jo Doe", Eppn: "jo@example.org"}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		suffix   string
+		fileName string
+		want     string
+	}{
+		{"no mapping", "", "", "dir/file.bam", "dir/file.bam"},
+		{"leading slash", "", "", "/dir/file.bam", "dir/file.bam"},
+		{"suffix added", "", ".c4gh", "file.bam", "file.bam.c4gh"},
+		{"suffix kept", "", ".c4gh", "file.bam.c4gh", "file.bam.c4gh"},
+		{"username prefix", "{{.Username}}/", ".c4gh", "file.bam", "jo_example.org/file.bam.c4gh"},
+		{"slashes collapsed", "{{.Username}}/", "", "/dir//file.bam", "jo_example.org/dir/file.bam"},
+		{"user id prefix", "inbox/{{.UserID}}/", "", "file.bam", "inbox/u1/file.bam"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapping, err := newPathMapping(test.prefix, test.suffix)
+			if err != nil {
+				t.Fatalf("newPathMapping returned %v", err)
+			}
+			got, err := mapping.apply(test.fileName, user)
+			if err != nil {
+				t.Fatalf("apply returned %v", err)
+			}
+			if got != test.want {
+				t.Errorf("apply(%q) = %q, want %q", test.fileName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPathMappingInvalidPrefix(t *testing.T) {
+	if _, err := newPathMapping("{{.Username", ""); err == nil {
+		t.Error("newPathMapping accepted an invalid template")
+	}
+
+	mapping, err := newPathMapping("{{.Unknown}}/", "")
+	if err != nil {
+		t.Fatalf("newPathMapping returned %v", err)
+	}
+	if _, err := mapping.apply("file.bam", User{}); err == nil {
+		t.Error("apply accepted an unknown field")
+	}
+}
+
+func TestPathMappingUnapply(t *testing.T) {
+	user := User{ID: "u1", Eppn: "jo@example.org"}
+	inbox, err := newPathMapping("{{.Username}}/", ".c4gh")
+	if err != nil {
+		t.Fatalf("newPathMapping returned %v", err)
+	}
+	db, err := newPathMapping("", ".c4gh")
+	if err != nil {
+		t.Fatalf("newPathMapping returned %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		mapping pathMapping
+		path    string
+		want    string
+	}{
+		{"inbox key", inbox, "jo_example.org/dir/file.bam.c4gh", "dir/file.bam"},
+		{"submission path", db, "dir/file.bam.c4gh", "dir/file.bam"},
+		{"other directory", inbox, "someone/file.bam.c4gh", "someone/file.bam"},
+		{"no suffix", inbox, "jo_example.org/file.bam", "file.bam"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.mapping.unapply(test.path, user)
+			if err != nil {
+				t.Fatalf("unapply returned %v", err)
+			}
+			if got != test.want {
+				t.Errorf("unapply(%q) = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
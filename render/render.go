@@ -0,0 +1,155 @@
+// Package render prints the records returned by the commands in the
+// output formats of the tool, independently of where they come from.
+package render
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	bson "go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v2"
+)
+
+// Format is the format used to print records
+type Format string
+
+// The supported formats
+const (
+	Table Format = "table"
+	JSON  Format = "json"
+	JSONL Format = "jsonl"
+	YAML  Format = "yaml"
+	CSV   Format = "csv"
+)
+
+// Formats lists the supported formats in the order shown in the help
+var Formats = []Format{Table, JSON, JSONL, YAML, CSV}
+
+// ParseFormat returns the format with the given name
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == name {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported output format %q", name)
+}
+
+// Record is implemented by the values that can be printed. Records are
+// serialised as relaxed extended JSON, so their bson tags define the field
+// names of the json, jsonl and yaml formats.
+type Record interface {
+	TableHeader() []string
+	TableRow() []string
+}
+
+// Print writes the records to w in the given format. The json
+// format is a single array and jsonl has one compact document per line, so
+// that both can be piped into other tools.
+func Print(w io.Writer, format Format, records []Record) error {
+	switch format {
+	case Table:
+		return printTable(w, records)
+	case CSV:
+		return printCSV(w, records)
+	case JSON:
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, r := range records {
+			out, err := bson.MarshalExtJSON(r, false, false)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(out)
+		}
+		buf.WriteByte(']')
+
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, buf.Bytes(), "", "  "); err != nil {
+			return err
+		}
+		indented.WriteByte('\n')
+		_, err := indented.WriteTo(w)
+
+		return err
+	case JSONL:
+		for _, r := range records {
+			out, err := bson.MarshalExtJSON(r, false, false)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(w, string(out)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case YAML:
+		// JSON is valid YAML, decoding into a MapSlice keeps the field order
+		docs := make([]yaml.MapSlice, 0, len(records))
+		for _, r := range records {
+			out, err := bson.MarshalExtJSON(r, false, false)
+			if err != nil {
+				return err
+			}
+			var doc yaml.MapSlice
+			if err := yaml.Unmarshal(out, &doc); err != nil {
+				return err
+			}
+			docs = append(docs, doc)
+		}
+		out, err := yaml.Marshal(docs)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+
+		return err
+	}
+
+	return fmt.Errorf("unsupported output format %q", format)
+}
+
+// printTable writes the records as aligned columns with a header
+func printTable(w io.Writer, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(records[0].TableHeader(), "\t"))
+	for _, r := range records {
+		fmt.Fprintln(tw, strings.Join(r.TableRow(), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// printCSV writes the table columns of the records as CSV with a header
+func printCSV(w io.Writer, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(records[0].TableHeader()); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := cw.Write(r.TableRow()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
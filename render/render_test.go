@@ -0,0 +1,71 @@
+package render
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+type testRecord struct {
+	Name  string `bson:"name"`
+	Count int    `bson:"count"`
+}
+
+func (r testRecord) TableHeader() []string {
+	return []string{"NAME", "COUNT"}
+}
+
+func (r testRecord) TableRow() []string {
+	return []string{r.Name, strconv.Itoa(r.Count)}
+}
+
+func TestPrint(t *testing.T) {
+	records := []Record{testRecord{Name: "a", Count: 1}, testRecord{Name: "b,c", Count: 2}}
+
+	tests := []struct {
+		name    string
+		format  Format
+		records []Record
+		want    string
+	}{
+		{"table", Table, records, "NAME  COUNT\na     1\nb,c   2\n"},
+		{"json", JSON, records, "[\n  {\n    \"name\": \"a\",\n    \"count\": 1\n  },\n  {\n    \"name\": \"b,c\",\n    \"count\": 2\n  }\n]\n"},
+		{"jsonl", JSONL, records, "{\"name\":\"a\",\"count\":1}\n{\"name\":\"b,c\",\"count\":2}\n"},
+		{"yaml", YAML, records, "- name: a\n  count: 1\n- name: b,c\n  count: 2\n"},
+		{"csv", CSV, records, "NAME,COUNT\na,1\n\"b,c\",2\n"},
+		{"empty table", Table, nil, ""},
+		{"empty json", JSON, nil, "[]\n"},
+		{"empty jsonl", JSONL, nil, ""},
+		{"empty yaml", YAML, nil, "[]\n"},
+		{"empty csv", CSV, nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Print(&out, test.format, test.records); err != nil {
+				t.Fatalf("Print returned %v", err)
+			}
+			if out.String() != test.want {
+				t.Errorf("Print wrote\n%q\nwant\n%q", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestPrintUnsupportedFormat(t *testing.T) {
+	if err := Print(&bytes.Buffer{}, Format("xml"), nil); err == nil {
+		t.Error("Print accepted an unsupported format")
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, f := range Formats {
+		if got, err := ParseFormat(string(f)); err != nil || got != f {
+			t.Errorf("ParseFormat(%q) = %q, %v", f, got, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat accepted xml")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metadataRepository answers the questions the commands ask the metadata
+// store with typed values, so that commands only compose its queries and
+// leave the presentation of the results to the render package
+type metadataRepository struct {
+	mongo *mongoClient
+}
+
+// users returns all users of the metadata store
+func (r metadataRepository) users(ctx context.Context) ([]User, error) {
+	return r.mongo.getAllUsers(ctx)
+}
+
+// user returns the user with the given id
+func (r metadataRepository) user(ctx context.Context, userID string) (User, error) {
+	return r.mongo.getUser(ctx, userID)
+}
+
+// folderOwner returns the user owning the given folder
+func (r metadataRepository) folderOwner(ctx context.Context, folderID string) (User, error) {
+	return r.mongo.getFolderOwner(ctx, folderID)
+}
+
+// objectOwner returns the user owning the folder that lists the metadata
+// object with the given accession id
+func (r metadataRepository) objectOwner(ctx context.Context, accessionID string) (User, error) {
+	folderID, err := r.mongo.getObjectFolder(ctx, accessionID)
+	if err != nil {
+		return User{}, err
+	}
+
+	return r.folderOwner(ctx, folderID)
+}
+
+// folders returns the folders with the given ids
+func (r metadataRepository) folders(ctx context.Context, folderIDs []string) ([]Folder, error) {
+	return r.mongo.getFolders(ctx, folderIDs)
+}
+
+// metadataCollections returns the metadata objects listed by the given
+// folders
+func (r metadataRepository) metadataCollections(ctx context.Context, folderIDs []string) ([]MetadataCollection, error) {
+	return r.mongo.getMetadataCollections(ctx, folderIDs)
+}
+
+// schemas returns the schemas there are metadata objects for
+func (r metadataRepository) schemas(ctx context.Context) ([]string, error) {
+	return r.mongo.getSchemas(ctx)
+}
+
+// metadataObjects returns the metadata objects of a schema with the given
+// accession ids
+func (r metadataRepository) metadataObjects(ctx context.Context, schema string, accessionIds []string) ([]metadataDocument, error) {
+	return r.mongo.getMetadataObjects(ctx, schema, accessionIds)
+}
+
+// objectFiles returns the files listed by the metadata objects of a schema
+// with the given accession ids
+func (r metadataRepository) objectFiles(ctx context.Context, schema string, accessionIds []string) ([]metadataFile, error) {
+	return r.mongo.getFilesFromObjects(ctx, schema, accessionIds)
+}
+
+// filterFolders returns the folder in the filter, or all folders of the
+// user in the filter when no folder is given
+func (r metadataRepository) filterFolders(ctx context.Context, filter metadataFilter) ([]string, error) {
+	if filter.FolderID != "" {
+		return []string{filter.FolderID}, nil
+	}
+
+	user, err := r.user(ctx, filter.UserID)
+
+	return user.Folders, err
+}
+
+// submitter returns the user in the filter, or the owner of the folder in
+// the filter when no user is given, or else the owner of the folder listing
+// the object in the filter
+func (r metadataRepository) submitter(ctx context.Context, filter metadataFilter) (User, error) {
+	switch {
+	case filter.UserID != "":
+		return r.user(ctx, filter.UserID)
+	case filter.FolderID != "":
+		return r.folderOwner(ctx, filter.FolderID)
+	case filter.AccessionID != "":
+		return r.objectOwner(ctx, filter.AccessionID)
+	}
+
+	return User{}, nil
+}
+
+// filterObjects returns the accession ids and schemas of the metadata
+// objects selected by the filter. When only an accession id is given all
+// schemas are returned, since the schema of the object is not known. An
+// empty filter is an error.
+func (r metadataRepository) filterObjects(ctx context.Context, filter metadataFilter) ([]string, []string, error) {
+	if err := needAnyID.check(filter); err != nil {
+		return nil, nil, err
+	}
+
+	var accessionIds []string
+	var schemas []string
+
+	if filter.FolderID != "" || filter.UserID != "" {
+		folders, err := r.filterFolders(ctx, filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		metadataCollections, err := r.metadataCollections(ctx, folders)
+		if err != nil {
+			return nil, nil, err
+		}
+		accessionIds, schemas = getAccessionIdsAndSchemas(metadataCollections)
+	} else {
+		var err error
+		schemas, err = r.schemas(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if filter.AccessionID != "" {
+		accessionIds = []string{filter.AccessionID}
+	}
+
+	log.Debugf("Accession ids are: %s", strings.Join(accessionIds, " "))
+	log.Debugf("Schemas are: %s", strings.Join(schemas, " "))
+
+	return accessionIds, schemas, nil
+}
+
+// metadataFiles returns the files of all metadata objects selected by the
+// filter, whatever their schema
+func (r metadataRepository) metadataFiles(ctx context.Context, filter metadataFilter) ([]metadataFile, error) {
+	accessionIds, schemas, err := r.filterObjects(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []metadataFile
+	for _, sch := range schemas {
+		objectFiles, err := r.objectFiles(ctx, sch, accessionIds)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, objectFiles...)
+	}
+
+	return files, nil
+}
+
+// userFiles returns the files of the metadata objects in all folders of
+// the user, which are the files the user may have uploaded
+func (r metadataRepository) userFiles(ctx context.Context, user User) ([]metadataFile, error) {
+	return r.metadataFiles(ctx, metadataFilter{UserID: user.ID})
+}
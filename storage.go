@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"reflect"
@@ -13,17 +19,26 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
 )
 
 type s3Backend struct {
-	Client   *s3.S3
-	Uploader *s3manager.Uploader
-	Bucket   string
-	Conf     *S3Config
+	Client readOnlyS3
+	Bucket string
+	Conf   *S3Config
+}
+
+// readOnlyS3 holds the only S3 operations the tool may use, so that it
+// cannot write to the inbox by mistake
+type readOnlyS3 interface {
+	HeadBucketWithContext(aws.Context, *s3.HeadBucketInput, ...request.Option) (*s3.HeadBucketOutput, error)
+	GetBucketAclWithContext(aws.Context, *s3.GetBucketAclInput, ...request.Option) (*s3.GetBucketAclOutput, error)
+	ListObjectsV2PagesWithContext(aws.Context, *s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool, ...request.Option) error
+	HeadObjectWithContext(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+	GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
 }
 
 // S3Config stores information about the S3 storage backend
@@ -34,13 +49,12 @@ type S3Config struct {
 	SecretKey         string
 	Bucket            string
 	Region            string
-	UploadConcurrency int
-	Chunksize         int
 	Cacert            string
 	NonExistRetryTime time.Duration
+	Paths             pathMapping
 }
 
-func newS3Backend(config S3Config) (*s3Backend, error) {
+func newS3Backend(ctx context.Context, config S3Config) (*s3Backend, error) {
 	s3Transport := transportConfigS3(config)
 	client := http.Client{Transport: s3Transport}
 	s3Session := session.Must(session.NewSession(
@@ -54,36 +68,15 @@ func newS3Backend(config S3Config) (*s3Backend, error) {
 		},
 	))
 
-	// Attempt to create a bucket, but we really expect an error here
-	// (BucketAlreadyOwnedByYou)
-	_, err := s3.New(s3Session).CreateBucket(&s3.CreateBucketInput{
-		Bucket: aws.String(config.Bucket),
-	})
-
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-
-			if aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou &&
-				aerr.Code() != s3.ErrCodeBucketAlreadyExists {
-				log.Error("Unexpected issue while creating bucket", err)
-			}
-		}
-	}
-
 	sb := &s3Backend{
 		Bucket: config.Bucket,
-		Uploader: s3manager.NewUploader(s3Session, func(u *s3manager.Uploader) {
-			u.PartSize = int64(config.Chunksize)
-			u.Concurrency = config.UploadConcurrency
-			u.LeavePartsOnError = false
-		}),
 		Client: s3.New(s3Session),
 		Conf:   &config}
 
-	_, err = sb.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &config.Bucket})
-
+	// The bucket is never created, it must exist already
+	_, err := sb.Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(config.Bucket)})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bucket %s is not accessible: %v", config.Bucket, err)
 	}
 
 	return sb, nil
@@ -121,50 +114,320 @@ func transportConfigS3(config S3Config) http.RoundTripper {
 	return trConfig
 }
 
-// GetFileSize returns the size of a specific object
-func (sb *s3Backend) GetFileSize(filePath string) (bool, error) {
+// ObjectKey returns the key of a file from the metadata in the bucket
+func (sb *s3Backend) ObjectKey(fileName string, user User) (string, error) {
+	if sb == nil || sb.Conf == nil {
+		return "", fmt.Errorf("Invalid s3Backend")
+	}
+
+	return sb.Conf.Paths.apply(fileName, user)
+}
+
+// FileName returns the name of the file with the given key in the bucket,
+// as it would be listed in the metadata
+func (sb *s3Backend) FileName(key string, user User) (string, error) {
+	if sb == nil || sb.Conf == nil {
+		return "", fmt.Errorf("Invalid s3Backend")
+	}
+
+	return sb.Conf.Paths.unapply(key, user)
+}
+
+// UserPrefix returns the prefix of the keys of the files submitted by user
+// in the bucket, empty when the keys have no prefix
+func (sb *s3Backend) UserPrefix(user User) (string, error) {
+	if sb == nil || sb.Conf == nil {
+		return "", fmt.Errorf("Invalid s3Backend")
+	}
+
+	return sb.Conf.Paths.userPrefix(user)
+}
+
+// Grants returns the permissions granted on the bucket by its ACL, as
+// grantee: permission
+func (sb *s3Backend) Grants(ctx context.Context) ([]string, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid s3Backend")
+	}
+
+	acl, err := sb.Client.GetBucketAclWithContext(ctx, &s3.GetBucketAclInput{Bucket: aws.String(sb.Bucket)})
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []string
+	for _, g := range acl.Grants {
+		if g.Grantee == nil {
+			continue
+		}
+		grantee := aws.StringValue(g.Grantee.DisplayName)
+		if grantee == "" {
+			grantee = aws.StringValue(g.Grantee.ID) + aws.StringValue(g.Grantee.URI)
+		}
+		grants = append(grants, grantee+": "+aws.StringValue(g.Permission))
+	}
+
+	return grants, nil
+}
+
+// inboxObject describes an object in the inbox bucket
+type inboxObject struct {
+	Key          string    `bson:"key"`
+	Size         int64     `bson:"size"`
+	LastModified time.Time `bson:"lastModified"`
+}
+
+// ListFiles returns all objects in the bucket under prefix, following the
+// pagination of the listing
+func (sb *s3Backend) ListFiles(ctx context.Context, prefix string) ([]inboxObject, error) {
 	if sb == nil {
-		return false, fmt.Errorf("Invalid s3Backend")
+		return nil, fmt.Errorf("Invalid s3Backend")
 	}
 
-	_, err := sb.Client.HeadObject(&s3.HeadObjectInput{
+	var objects []inboxObject
+	err := sb.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
 		Bucket: aws.String(sb.Bucket),
-		Key:    aws.String(filePath)})
+		Prefix: aws.String(prefix)},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				objects = append(objects, inboxObject{
+					Key:          aws.StringValue(obj.Key),
+					Size:         aws.Int64Value(obj.Size),
+					LastModified: aws.TimeValue(obj.LastModified)})
+			}
 
-	/*start := time.Now()
+			return true
+		})
 
-	retryTime := 2 * time.Minute
+	return objects, err
+}
+
+// CheckList makes sure the bucket can be listed, only a single key is
+// requested
+func (sb *s3Backend) CheckList(ctx context.Context) error {
+	if sb == nil {
+		return fmt.Errorf("Invalid s3Backend")
+	}
+
+	return sb.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(sb.Bucket),
+		MaxKeys: aws.Int64(1)},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			return false
+		})
+}
+
+// objectState tells whether an object was found in the bucket
+type objectState int
+
+const (
+	// objectUnknown is used when the lookup failed, the error tells why
+	objectUnknown objectState = iota
+	objectPresent
+	objectAbsent
+)
+
+// objectInfo holds what the bucket reports about an object, Checksums
+// maps normalised algorithm names to the checksums stored in the user
+// metadata of the object, like x-amz-meta-md5 or x-amz-meta-checksum-sha256
+type objectInfo struct {
+	State     objectState
+	Size      int64
+	ETag      string
+	Checksums map[string]string
+}
+
+// multipart returns true if the ETag is the one of a multipart upload, which
+// is not the MD5 of the object content
+func (o objectInfo) multipart() bool {
+	return strings.Contains(o.ETag, "-")
+}
+
+// storedChecksums picks the checksums out of the user metadata of an object
+func storedChecksums(metadata map[string]*string) map[string]string {
+	checksums := map[string]string{}
+	for key, value := range metadata {
+		method := strings.TrimPrefix(normaliseChecksumMethod(key), "checksum")
+		switch method {
+		case "md5", "sha1", "sha256", "sha384", "sha512":
+			checksums[method] = aws.StringValue(value)
+		}
+	}
+
+	return checksums
+}
+
+// statRetrySleep is how long to wait between lookups of the same object
+var statRetrySleep = 1 * time.Second
+
+// StatFile returns the state, size and ETag of a specific object. Failed
+// lookups are retried until NonExistRetryTime has passed to allow for
+// "slow writes" or s3 eventual consistency. An object that is still not
+// found is reported as absent, any other error leaves the state unknown.
+// No retry is started that would end after the deadline of ctx, and an
+// object that was not found before ctx was done is reported as absent.
+func (sb *s3Backend) StatFile(ctx context.Context, filePath string) (objectInfo, error) {
+	if sb == nil {
+		return objectInfo{}, fmt.Errorf("Invalid s3Backend")
+	}
+
+	var retryTime time.Duration
 	if sb.Conf != nil {
 		retryTime = sb.Conf.NonExistRetryTime
-	}*/
+	}
 
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case "NotFound":
-				return false, nil
-			default:
-				log.Info(err)
+	start := time.Now()
+	notFound := false
+	for {
+		r, err := sb.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(filePath)})
+
+		if err == nil {
+			return objectInfo{
+				State:     objectPresent,
+				Size:      aws.Int64Value(r.ContentLength),
+				ETag:      strings.Trim(aws.StringValue(r.ETag), `"`),
+				Checksums: storedChecksums(r.Metadata)}, nil
+		}
+
+		// a lookup aborted by ctx tells nothing about the object
+		if ctx.Err() == nil {
+			notFound = isNotFound(err)
+		}
+
+		next := time.Now().Add(statRetrySleep)
+		deadline, hasDeadline := ctx.Deadline()
+		if next.Sub(start) > retryTime || (hasDeadline && next.After(deadline)) || ctx.Err() != nil {
+			if notFound {
+				return objectInfo{State: objectAbsent}, nil
 			}
+
+			return objectInfo{State: objectUnknown}, err
+		}
+
+		log.Debugf("Lookup of %s failed, retrying: %v", filePath, err)
+		select {
+		case <-time.After(statRetrySleep):
+		case <-ctx.Done():
 		}
 	}
-	return true, nil
+}
 
-	// Retry on error up to five minutes to allow for
-	// "slow writes' or s3 eventual consistency
-	/*for err != nil && time.Since(start) < retryTime {
-		r, err = sb.Client.HeadObject(&s3.HeadObjectInput{
-			Bucket: aws.String(sb.Bucket),
-			Key:    aws.String(filePath)})
+// isNotFound returns true if err tells that an object does not exist
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchKey:
+			return true
+		}
+	}
 
-		time.Sleep(1 * time.Second)
+	return false
+}
+
+// crypt4ghHeaderRange is how much of an object is read to recognise a
+// Crypt4GH header, a header with a packet for each of hundreds of readers
+// still fits
+const crypt4ghHeaderRange = 65536
 
+// Crypt4GHState reads only the start of an object of the given size with a
+// ranged request and returns whether it is a Crypt4GH file with a valid
+// header. A header longer than crypt4ghHeaderRange is reported as invalid.
+func (sb *s3Backend) Crypt4GHState(ctx context.Context, filePath string, size int64) (string, error) {
+	if sb == nil {
+		return "", fmt.Errorf("Invalid s3Backend")
 	}
 
+	if size == 0 {
+		// a ranged request of an empty object is not satisfiable
+		return crypt4ghNo, nil
+	}
+	end := size
+	if end > crypt4ghHeaderRange {
+		end = crypt4ghHeaderRange
+	}
+
+	r, err := sb.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(filePath),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", end-1))})
 	if err != nil {
-		log.Errorln(err)
-		return 0, err
-	}*/
+		return "", err
+	}
+	defer r.Body.Close()
+
+	header, err := readCrypt4GHHeader(io.LimitReader(r.Body, end))
+	switch {
+	case err == errNotCrypt4GH:
+		return crypt4ghNo, nil
+	case err != nil:
+		log.Warnf("Invalid crypt4gh header in %s: %v", filePath, err)
+
+		return crypt4ghInvalid, nil
+	}
+	log.Debugf("%s is a crypt4gh file with %d header packets", filePath, len(header.Packets))
+
+	return crypt4ghValid, nil
+}
+
+// HashFile streams a specific object and returns its MD5 and SHA-256.
+// Crypt4GH files are recognised by their header, with a private key they
+// are decrypted in-stream and the hashes are the ones of the plaintext,
+// without a key the hashes are the ones of the encrypted object.
+func (sb *s3Backend) HashFile(ctx context.Context, filePath string, privateKey *[32]byte) (contentHashes, error) {
+	if sb == nil {
+		return contentHashes{}, fmt.Errorf("Invalid s3Backend")
+	}
+
+	r, err := sb.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(filePath)})
+	if err != nil {
+		return contentHashes{}, err
+	}
+	defer r.Body.Close()
+
+	md5Hash := md5.New() // #nosec md5 is only used to compare with the declared checksum
+	sha256Hash := sha256.New()
+	hashers := io.MultiWriter(md5Hash, sha256Hash)
+
+	hashes := contentHashes{Crypt4GH: crypt4ghNo}
+	body := bufio.NewReader(r.Body)
+	content := io.Reader(body)
+
+	if magic, _ := body.Peek(len(crypt4ghMagic)); string(magic) == crypt4ghMagic {
+		headerSource := io.Reader(body)
+		if privateKey == nil {
+			// the header is part of what is hashed
+			headerSource = io.TeeReader(body, hashers)
+		}
+
+		header, err := readCrypt4GHHeader(headerSource)
+		if err != nil {
+			log.Warnf("Invalid crypt4gh header in %s: %v", filePath, err)
+
+			return contentHashes{Crypt4GH: crypt4ghInvalid}, nil
+		}
+		hashes.Crypt4GH = crypt4ghValid
+		log.Debugf("%s is a crypt4gh file with %d header packets", filePath, len(header.Packets))
+
+		if privateKey != nil {
+			keys, err := header.dataKeys(*privateKey)
+			if err != nil {
+				return contentHashes{}, fmt.Errorf("failed to decrypt %s: %v", filePath, err)
+			}
+			content = newCrypt4GHReader(body, keys)
+			hashes.Decrypted = true
+		}
+	}
+
+	if _, err := io.Copy(hashers, content); err != nil {
+		return contentHashes{}, err
+	}
+
+	hashes.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	hashes.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
 
-	//return *r.ContentLength, nil
+	return hashes, nil
 }
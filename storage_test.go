@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 answers the lookups of objects with head and serves the ranges
+// of body that are asked for, the other operations are not used by these
+// tests
+type fakeS3 struct {
+	readOnlyS3
+	head   func(ctx aws.Context) (*s3.HeadObjectOutput, error)
+	body   []byte
+	ranges *[]string
+}
+
+func (f fakeS3) HeadObjectWithContext(ctx aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	return f.head(ctx)
+}
+
+func (f fakeS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	body := f.body
+	if input.Range != nil {
+		*f.ranges = append(*f.ranges, *input.Range)
+		var start, end int
+		if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		if end >= len(body) {
+			end = len(body) - 1
+		}
+		body = body[start : end+1]
+	}
+
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func TestStatFile(t *testing.T) {
+	notFound := awserr.New("NotFound", "Not Found", nil)
+	denied := awserr.New("AccessDenied", "Access Denied", nil)
+
+	tests := []struct {
+		name      string
+		retryTime time.Duration
+		timeout   time.Duration
+		head      func(ctx aws.Context) (*s3.HeadObjectOutput, error)
+		want      objectState
+	}{
+		{"present", 0, time.Second, func(aws.Context) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{ContentLength: aws.Int64(3), ETag: aws.String(`"abc"`)}, nil
+		}, objectPresent},
+		{"absent", 0, time.Second, func(aws.Context) (*s3.HeadObjectOutput, error) {
+			return nil, notFound
+		}, objectAbsent},
+		{"denied", 0, time.Second, func(aws.Context) (*s3.HeadObjectOutput, error) {
+			return nil, denied
+		}, objectUnknown},
+		{"absent until the request timeout", time.Minute, 50 * time.Millisecond, func(aws.Context) (*s3.HeadObjectOutput, error) {
+			return nil, notFound
+		}, objectAbsent},
+		{"lookup aborted by the request timeout", time.Minute, 50 * time.Millisecond, func(ctx aws.Context) (*s3.HeadObjectOutput, error) {
+			<-ctx.Done()
+
+			return nil, errors.New("request canceled")
+		}, objectUnknown},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sb := &s3Backend{Client: fakeS3{head: test.head}, Bucket: "inbox", Conf: &S3Config{NonExistRetryTime: test.retryTime}}
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+
+			start := time.Now()
+			info, err := sb.StatFile(ctx, "file.c4gh")
+			if info.State != test.want {
+				t.Errorf("StatFile returned state %v and %v, want %v", info.State, err, test.want)
+			}
+			if elapsed := time.Since(start); elapsed > test.timeout+statRetrySleep {
+				t.Errorf("StatFile took %s with a timeout of %s", elapsed, test.timeout)
+			}
+		})
+	}
+}
+
+func TestCrypt4GHState(t *testing.T) {
+	_, public := newTestKeyPair(t)
+	file := encryptTestFile(t, testPlaintext(t), public)
+	version := append([]byte{}, file...)
+	version[8] = 2
+
+	tests := []struct {
+		name   string
+		body   []byte
+		want   string
+		ranges []string
+	}{
+		{"crypt4gh", file, crypt4ghValid, []string{fmt.Sprintf("bytes=0-%d", crypt4ghHeaderRange-1)}},
+		{"invalid header", version, crypt4ghInvalid, []string{fmt.Sprintf("bytes=0-%d", crypt4ghHeaderRange-1)}},
+		{"truncated header", file[:30], crypt4ghInvalid, []string{"bytes=0-29"}},
+		{"plain", []byte("@HD\tVN:1.6\n"), crypt4ghNo, []string{"bytes=0-10"}},
+		{"empty", nil, crypt4ghNo, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ranges []string
+			sb := &s3Backend{Client: fakeS3{body: test.body, ranges: &ranges}, Bucket: "inbox", Conf: &S3Config{}}
+
+			state, err := sb.Crypt4GHState(context.Background(), "file.c4gh", int64(len(test.body)))
+			if err != nil || state != test.want {
+				t.Errorf("Crypt4GHState returned %q and %v, want %q", state, err, test.want)
+			}
+			if fmt.Sprint(ranges) != fmt.Sprint(test.ranges) {
+				t.Errorf("Crypt4GHState read %v, want %v", ranges, test.ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Values of contentHashes.Crypt4GH
+const (
+	crypt4ghNo      = "no"
+	crypt4ghValid   = "valid"
+	crypt4ghInvalid = "invalid"
+)
+
+// crypt4ghSuffix ends the keys of the Crypt4GH encrypted inbox objects
+const crypt4ghSuffix = ".c4gh"
+
+// contentHashes holds the checksums computed from the content of an object,
+// whether it is a Crypt4GH file and whether the hashes are of its plaintext
+type contentHashes struct {
+	MD5       string `json:"md5"`
+	SHA256    string `json:"sha256"`
+	Crypt4GH  string `json:"crypt4gh"`
+	Decrypted bool   `json:"decrypted"`
+}
+
+// checksum returns the hash computed with the given algorithm, or an empty
+// string if it is not computed
+func (h contentHashes) checksum(method string) string {
+	switch normaliseChecksumMethod(method) {
+	case "md5":
+		return h.MD5
+	case "sha256":
+		return h.SHA256
+	}
+
+	return ""
+}
+
+// verifyCache keeps the hashes of verified objects on disk, so that an
+// interrupted verification can be resumed without reading the objects
+// again. Entries are keyed by bucket, key, ETag and size, so a changed
+// object is hashed again. The file holds one JSON entry per line and is
+// only ever appended to.
+type verifyCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]contentHashes
+}
+
+// verifyCacheEntry is a line of the cache file
+type verifyCacheEntry struct {
+	Key string `json:"key"`
+	contentHashes
+}
+
+// loadVerifyCache reads the cache at path, a missing file gives an empty
+// cache and an empty path disables the cache. Later lines replace earlier
+// ones with the same key, and a last line cut by an interruption is
+// ignored.
+func loadVerifyCache(path string) (*verifyCache, error) {
+	c := &verifyCache{path: path, entries: map[string]contentHashes{}}
+	if path == "" {
+		return c, nil
+	}
+
+	f, err := os.Open(path) // #nosec this file comes from the command line
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry verifyCacheEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warnf("Ignoring line %d of the verification cache %s: %v", line, path, err)
+
+			continue
+		}
+		c.entries[entry.Key] = entry.contentHashes
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read verification cache %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// cacheKey returns the key of an object in the cache, hashes of decrypted
+// content are kept apart from the hashes of the objects themselves
+func cacheKey(bucket, key, etag string, size int64, decrypted bool) string {
+	k := fmt.Sprintf("%s/%s|%s|%d", bucket, key, etag, size)
+	if decrypted {
+		k += "|decrypted"
+	}
+
+	return k
+}
+
+func (c *verifyCache) get(key string) (contentHashes, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.entries[key]
+
+	return h, ok
+}
+
+// put adds an entry and appends it to the cache file
+func (c *verifyCache) put(key string, h contentHashes) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = h
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(verifyCacheEntry{Key: key, contentHashes: h})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600) // #nosec this file comes from the command line
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+// verifyContent streams the inbox objects of the results through the
+// hash functions with the concurrency of the pool, and compares the hashes
+// with the metadata checksums. Results for files that are not in the inbox
+// are left untouched. Crypt4GH files are decrypted when a private key is
+// given. Downloads are not subject to the request timeout of the pool.
+func verifyContent(ctx context.Context, pool workerPool, inbox *s3Backend, results []CrossRefResult, cache *verifyCache, privateKey *[32]byte) error {
+	var todo []*CrossRefResult
+	for i := range results {
+		if results[i].InInbox != nil && *results[i].InInbox {
+			todo = append(todo, &results[i])
+		}
+	}
+
+	var (
+		mu   sync.Mutex
+		done int
+	)
+	pool.timeout = 0
+
+	return pool.forEach(ctx, len(todo), func(ctx context.Context, i int) {
+		r := todo[i]
+		key := cacheKey(inbox.Bucket, r.InboxKey, r.InboxETag, *r.InboxSize, privateKey != nil)
+		hashes, cached := cache.get(key)
+		if !cached {
+			var err error
+			hashes, err = inbox.HashFile(ctx, r.InboxKey, privateKey)
+			if err != nil {
+				r.setError(err)
+
+				return
+			}
+			if err := cache.put(key, hashes); err != nil {
+				log.Warnf("Could not save the verification cache: %v", err)
+			}
+		}
+		r.setContentHashes(hashes)
+
+		mu.Lock()
+		done++
+		log.Infof("Verified %d/%d files: %s (cached: %t)", done, len(todo), r.FileName, cached)
+		mu.Unlock()
+	})
+}
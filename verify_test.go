@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCache(t *testing.T) {
+	path := filepath.Join(testDir(t), "cache.jsonl")
+
+	cache, err := loadVerifyCache(path)
+	if err != nil {
+		t.Fatalf("loadVerifyCache returned %v", err)
+	}
+	first := contentHashes{MD5: "a", SHA256: "b", Crypt4GH: crypt4ghNo}
+	second := contentHashes{MD5: "c", SHA256: "d", Crypt4GH: crypt4ghValid, Decrypted: true}
+	for _, put := range []struct {
+		key    string
+		hashes contentHashes
+	}{{"one", first}, {"two", first}, {"two", second}} {
+		if err := cache.put(put.key, put.hashes); err != nil {
+			t.Fatalf("put returned %v", err)
+		}
+	}
+
+	// an interrupted run may leave a partial last line
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"key":"three","md5":`)
+	f.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("the cache file has %d lines, want one per put", lines)
+	}
+
+	loaded, err := loadVerifyCache(path)
+	if err != nil {
+		t.Fatalf("loadVerifyCache returned %v", err)
+	}
+	if h, ok := loaded.get("one"); !ok || h != first {
+		t.Errorf("got %+v for one, want %+v", h, first)
+	}
+	if h, ok := loaded.get("two"); !ok || h != second {
+		t.Errorf("got %+v for two, want the last entry %+v", h, second)
+	}
+	if _, ok := loaded.get("three"); ok {
+		t.Error("the partial line was loaded")
+	}
+}
+
+func TestVerifyCacheDisabled(t *testing.T) {
+	cache, err := loadVerifyCache("")
+	if err != nil {
+		t.Fatalf("loadVerifyCache returned %v", err)
+	}
+	if err := cache.put("one", contentHashes{MD5: "a"}); err != nil {
+		t.Fatalf("put returned %v", err)
+	}
+	if _, ok := cache.get("one"); !ok {
+		t.Error("the disabled cache lost an entry within the run")
+	}
+}
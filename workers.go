@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// workerPool runs lookups against the backends concurrently. Each piece of
+// work gets its own timeout, and the results are stored by index so that
+// they keep the order of the metadata whatever order the work finishes in.
+type workerPool struct {
+	concurrency int
+	timeout     time.Duration
+}
+
+// addWorkerFlags adds the flags configuring the worker pool to flags
+func addWorkerFlags(flags *pflag.FlagSet) *pflag.FlagSet {
+	flags.Int("concurrency", 4, "number of lookups run at the same time")
+	flags.Duration("request-timeout", 30*time.Second, "timeout of each lookup in the inbox or the database, 0 for none")
+
+	return flags
+}
+
+// newWorkerPool returns a pool configured from the flags of a command
+func newWorkerPool(flags *pflag.FlagSet) workerPool {
+	concurrency, _ := flags.GetInt("concurrency")
+	timeout, _ := flags.GetDuration("request-timeout")
+
+	return workerPool{concurrency: concurrency, timeout: timeout}
+}
+
+// forEach calls work for the indices 0 to n-1, at most concurrency at a
+// time. No more work is handed out once ctx is cancelled, the error of the
+// context is returned in that case.
+func (p workerPool) forEach(ctx context.Context, n int, work func(ctx context.Context, i int)) error {
+	concurrency := p.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				p.run(ctx, i, work)
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < n; i++ {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// run calls work for a single index with the timeout of the pool
+func (p workerPool) run(ctx context.Context, i int, work func(ctx context.Context, i int)) {
+	var cancel context.CancelFunc
+	if p.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	work(ctx, i)
+}
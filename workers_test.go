@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachKeepsOrder(t *testing.T) {
+	const n = 50
+	pool := workerPool{concurrency: 8}
+
+	results := make([]int, n)
+	err := pool.forEach(context.Background(), n, func(ctx context.Context, i int) {
+		// the later indices finish first
+		time.Sleep(time.Duration(n-i) * 100 * time.Microsecond)
+		results[i] = i * i
+	})
+	if err != nil {
+		t.Fatalf("forEach returned %v", err)
+	}
+
+	for i, r := range results {
+		if r != i*i {
+			t.Fatalf("results[%d] = %d, want %d", i, r, i*i)
+		}
+	}
+}
+
+func TestForEachConcurrency(t *testing.T) {
+	pool := workerPool{concurrency: 3}
+
+	var running, max int32
+	err := pool.forEach(context.Background(), 20, func(ctx context.Context, i int) {
+		now := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&max)
+			if now <= old || atomic.CompareAndSwapInt32(&max, old, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	})
+	if err != nil {
+		t.Fatalf("forEach returned %v", err)
+	}
+	if max > 3 {
+		t.Errorf("%d pieces of work ran at the same time, want at most 3", max)
+	}
+}
+
+func TestForEachTimeout(t *testing.T) {
+	pool := workerPool{concurrency: 2, timeout: time.Millisecond}
+
+	timedOut := make([]bool, 4)
+	err := pool.forEach(context.Background(), len(timedOut), func(ctx context.Context, i int) {
+		<-ctx.Done()
+		timedOut[i] = ctx.Err() == context.DeadlineExceeded
+	})
+	if err != nil {
+		t.Fatalf("forEach returned %v", err)
+	}
+	for i, ok := range timedOut {
+		if !ok {
+			t.Errorf("work %d did not time out", i)
+		}
+	}
+}
+
+func TestForEachCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls int32
+	err := workerPool{concurrency: 1}.forEach(ctx, 100, func(ctx context.Context, i int) {
+		atomic.AddInt32(&calls, 1)
+	})
+	if err != context.Canceled {
+		t.Errorf("forEach returned %v, want %v", err, context.Canceled)
+	}
+	if calls == 100 {
+		t.Error("all work was handed out after the context was cancelled")
+	}
+}